@@ -0,0 +1,34 @@
+// Jitconfig prints JIT config that autoscaler stored to Secrets Manager or SSM Parameter Store. Runner task gets only
+// reference to it in ACTIONS_RUNNER_INPUT_JITCONFIG_REF, and kind of the store in ACTIONS_RUNNER_INPUT_JITCONFIG_STORE.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/aws"
+)
+
+func main() {
+	reference, err1 := requireEnv("ACTIONS_RUNNER_INPUT_JITCONFIG_REF")
+	store, err2 := requireEnv("ACTIONS_RUNNER_INPUT_JITCONFIG_STORE")
+	if errors.Join(err1, err2) != nil {
+		log.Fatal(errors.Join(err1, err2))
+	}
+	jitConfig, err := aws.ReadJitConfig(context.Background(), store, reference)
+	if err != nil {
+		log.Fatalf("Could not read JIT config %s: %s", reference, err)
+	}
+	fmt.Print(jitConfig)
+}
+
+func requireEnv(key string) (value string, err error) {
+	value = os.Getenv(key)
+	if len(value) == 0 {
+		err = fmt.Errorf("value required for environment variable %s", key)
+	}
+	return
+}
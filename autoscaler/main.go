@@ -10,12 +10,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/aws"
 	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/azure"
 	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/gcp"
 	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/kubernetes"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/local"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/nomad"
 )
 
 func main() {
@@ -54,14 +58,46 @@ func main() {
 		handler = crClient
 	}
 
+	k8sClient, k8sErr := kubernetes.GetClient(ctx, logger)
+	if handler == nil && k8sClient != nil {
+		logger.Info("Using Kubernetes Jobs for runners")
+		handler = k8sClient
+	}
+
+	nomadClient, nomadErr := nomad.GetClient(ctx, logger)
+	if handler == nil && nomadClient != nil {
+		logger.Info("Using HashiCorp Nomad for runners")
+		handler = nomadClient
+	}
+
+	localClient, localErr := local.GetClient(ctx, logger)
+	if handler == nil && localClient != nil {
+		logger.Info("Using local processes for runners")
+		handler = localClient
+		defer func() {
+			// Runner processes are stopped when context is done
+			stop()
+			localClient.Wait()
+		}()
+	}
+
 	if handler == nil {
-		logger.Error("Not able to create any client", slog.Any("acaErr", acaErr), slog.Any("ecsErr", ecsErr), slog.Any("crErr", crErr))
+		logger.Error("Not able to create any client", slog.Any("acaErr", acaErr), slog.Any("ecsErr", ecsErr), slog.Any("crErr", crErr), slog.Any("k8sErr", k8sErr), slog.Any("nomadErr", nomadErr), slog.Any("localErr", localErr))
 		return
 	}
 
+	if reaper, ok := handler.(github.RunnerReaper); ok {
+		go reaper.StartReaper()
+	}
+
 	scaleSetName := getenv("SCALE_SET_NAME", "serverless-scale-set")
 	client := github.CreateActionsServiceClient(ctx, pat, githubConfigUrl, logger)
-	defer client.Client.CloseIdleConnections()
+	defer client.Close()
+	client.RunnerNamePrefix = getenv("RUNNER_NAME_PREFIX", scaleSetName)
+	client.RunnerWorkFolder = os.Getenv("RUNNER_WORK_FOLDER")
+	if client.MaxRequestAttempts, err = strconv.Atoi(getenv("MAX_REQUEST_ATTEMPTS", "5")); err != nil || client.MaxRequestAttempts < 1 {
+		log.Fatalf("MAX_REQUEST_ATTEMPTS has to be positive integer, got %s", os.Getenv("MAX_REQUEST_ATTEMPTS"))
+	}
 	scaleSet, _ := client.Client.GetRunnerScaleSet(ctx, 1, scaleSetName)
 	if scaleSet != nil {
 		logger.Info(fmt.Sprintf("Using existing scale set %s (ID %x). Runner group id %x", scaleSet.Name, scaleSet.Id, scaleSet.RunnerGroupId))
@@ -7,13 +7,20 @@ import (
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/google/uuid"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
 )
 
+// Maximum time to wait for runner task before its JIT config is removed anyway. JIT configs older than this are also
+// removed at startup.
+const jitConfigMaxAge = 24 * time.Hour
+
 type Ecs struct {
 	ctx               context.Context
 	logger            *slog.Logger
@@ -23,6 +30,10 @@ type Ecs struct {
 	cluster           *string
 	subnets           []string
 	securityGroups    []string
+	jitConfigStore    jitConfigStore
+	jitConfigKind     string
+	jitConfigPrefix   string
+	jitConfigDeleteOn string
 }
 
 func GetClient(ctx context.Context, logger *slog.Logger) (*Ecs, error) {
@@ -40,7 +51,17 @@ func GetClient(ctx context.Context, logger *slog.Logger) (*Ecs, error) {
 
 	client := ecs.NewFromConfig(cfg)
 
-	return &Ecs{
+	jitConfigKind := getenv("JIT_CONFIG_STORE", jitConfigStoreEnv)
+	store, err := newJitConfigStore(jitConfigKind, cfg)
+	if err != nil {
+		return nil, err
+	}
+	jitConfigDeleteOn := getenv("JIT_CONFIG_DELETE_ON", "stop")
+	if jitConfigDeleteOn != "start" && jitConfigDeleteOn != "stop" {
+		return nil, fmt.Errorf("unknown JIT_CONFIG_DELETE_ON %s, expected start or stop", jitConfigDeleteOn)
+	}
+
+	e := &Ecs{
 		ctx:               ctx,
 		logger:            logger,
 		client:            client,
@@ -49,7 +70,15 @@ func GetClient(ctx context.Context, logger *slog.Logger) (*Ecs, error) {
 		subnets:           strings.Split(subnets, ","),
 		securityGroups:    strings.Split(securityGroups, ","),
 		starter:           aws.String("action-runner-scaler"),
-	}, nil
+		jitConfigStore:    store,
+		jitConfigKind:     jitConfigKind,
+		jitConfigPrefix:   getenv("JIT_CONFIG_PREFIX", "/gha-runner-jit/"),
+		jitConfigDeleteOn: jitConfigDeleteOn,
+	}
+	if store != nil {
+		go e.removeExpiredJitConfigs()
+	}
+	return e, nil
 }
 
 func (e *Ecs) CurrentRunnerCount() (int, error) {
@@ -76,10 +105,37 @@ func (e *Ecs) CurrentRunnerCount() (int, error) {
 	return taskCount, err
 }
 
-func (e *Ecs) TriggerNewRunners(jitConfigs []string) (err error) {
+func (e *Ecs) TriggerNewRunners(runners []github.RunnerRequest) (started []int64, err error) {
 	var errs []error
 
-	for _, jitConfig := range jitConfigs {
+	for _, runner := range runners {
+		environment := []types.KeyValuePair{
+			{
+				Name:  aws.String("ACTIONS_RUNNER_INPUT_JITCONFIG"),
+				Value: aws.String(runner.JitConfig),
+			},
+		}
+
+		var reference string
+		if e.jitConfigStore != nil {
+			name := fmt.Sprintf("%s%d-%s", e.jitConfigPrefix, runner.RequestId, uuid.NewString())
+			reference, err = e.jitConfigStore.store(e.ctx, name, runner.JitConfig)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			// Runner has to resolve the reference itself, so only that is passed to the task
+			environment = []types.KeyValuePair{
+				{
+					Name:  aws.String("ACTIONS_RUNNER_INPUT_JITCONFIG_REF"),
+					Value: aws.String(reference),
+				},
+				{
+					Name:  aws.String("ACTIONS_RUNNER_INPUT_JITCONFIG_STORE"),
+					Value: aws.String(e.jitConfigKind),
+				},
+			}
+		}
 
 		input := &ecs.RunTaskInput{
 			StartedBy:      e.starter,
@@ -96,43 +152,102 @@ func (e *Ecs) TriggerNewRunners(jitConfigs []string) (err error) {
 			Overrides: &types.TaskOverride{
 				ContainerOverrides: []types.ContainerOverride{
 					{
-						Name: aws.String("runner"),
-						Environment: []types.KeyValuePair{
-							{
-								Name:  aws.String("ACTIONS_RUNNER_INPUT_JITCONFIG"),
-								Value: &jitConfig,
-							},
-						},
+						Name:        aws.String("runner"),
+						Environment: environment,
 					},
 				},
 			},
 		}
 
-		_, err := e.client.RunTask(e.ctx, input)
+		output, err := e.client.RunTask(e.ctx, input)
 		if err != nil {
 			errs = append(errs, err)
+		} else if len(output.Tasks) == 0 {
+			errs = append(errs, fmt.Errorf("no task was started for request %d: %s", runner.RequestId, taskFailures(output.Failures)))
+		} else {
+			started = append(started, runner.RequestId)
+		}
+		if reference != "" {
+			if err != nil || len(output.Tasks) == 0 {
+				e.removeJitConfig(reference)
+			} else {
+				go e.removeJitConfigAfterTask(output.Tasks[0].TaskArn, reference)
+			}
 		}
 	}
 
-	return errors.Join(errs...)
+	return started, errors.Join(errs...)
 }
 
-func (e *Ecs) NeededRunners(jitConfigs []string) (err error) {
+func taskFailures(failures []types.Failure) string {
+	var reasons []string
+	for _, failure := range failures {
+		reasons = append(reasons, aws.ToString(failure.Reason))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+func (e *Ecs) NeededRunners(runners []github.RunnerRequest) (err error) {
 	currentRunners, err := e.CurrentRunnerCount()
 	if err != nil {
 		return err
 	}
 
-	count := len(jitConfigs)
+	count := len(runners)
 	e.logger.Debug(fmt.Sprintf("%d/%d of runners available", currentRunners, count))
 	if count-currentRunners > 0 {
 		e.logger.Debug(fmt.Sprintf("Triggering %d runners", count-currentRunners))
-		return e.TriggerNewRunners(jitConfigs[0 : count-currentRunners])
+		_, err = e.TriggerNewRunners(runners[0 : count-currentRunners])
+		return err
 	}
 
 	return nil
 }
 
+// removeJitConfigAfterTask waits until task has started or stopped, depending on configuration, and removes JIT config of it
+func (e *Ecs) removeJitConfigAfterTask(taskArn *string, reference string) {
+	input := &ecs.DescribeTasksInput{
+		Cluster: e.cluster,
+		Tasks:   []string{*taskArn},
+	}
+	var err error
+	if e.jitConfigDeleteOn == "start" {
+		err = ecs.NewTasksRunningWaiter(e.client).Wait(e.ctx, input, jitConfigMaxAge)
+	} else {
+		err = ecs.NewTasksStoppedWaiter(e.client).Wait(e.ctx, input, jitConfigMaxAge)
+	}
+	if err != nil && e.ctx.Err() != nil {
+		// Task may still be provisioning and need the JIT config. Expired configs are removed at next startup.
+		e.logger.Debug(fmt.Sprintf("Stopped waiting for task %s, leaving its JIT config", *taskArn))
+		return
+	}
+	if err != nil {
+		e.logger.Warn(fmt.Sprintf("Waiting for task %s failed, removing its JIT config", *taskArn), slog.Any("err", err))
+	}
+	e.removeJitConfig(reference)
+}
+
+// removeExpiredJitConfigs removes JIT configs left from earlier runs of autoscaler
+func (e *Ecs) removeExpiredJitConfigs() {
+	removed, err := removeExpiredJitConfigs(e.ctx, e.jitConfigStore, e.jitConfigPrefix, jitConfigMaxAge)
+	if err != nil {
+		e.logger.Error("Could not remove all expired JIT configs", slog.Any("err", err))
+	}
+	if removed > 0 {
+		e.logger.Info(fmt.Sprintf("Removed %d expired JIT configs", removed))
+	}
+}
+
+func (e *Ecs) removeJitConfig(reference string) {
+	// Removal has to happen also when autoscaler is shutting down
+	err := e.jitConfigStore.remove(context.WithoutCancel(e.ctx), reference)
+	if err != nil {
+		e.logger.Error(fmt.Sprintf("Could not remove JIT config %s", reference), slog.Any("err", err))
+	} else {
+		e.logger.Debug(fmt.Sprintf("Removed JIT config %s", reference))
+	}
+}
+
 func requireEnv(key string) (value string, err error) {
 	value = os.Getenv(key)
 	if len(value) == 0 {
@@ -140,3 +255,11 @@ func requireEnv(key string) (value string, err error) {
 	}
 	return
 }
+
+func getenv(key, fallback string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	return value
+}
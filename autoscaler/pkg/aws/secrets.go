@@ -0,0 +1,207 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+const (
+	jitConfigStoreEnv            = "env"
+	jitConfigStoreSecretsManager = "secretsmanager"
+	jitConfigStoreSsm            = "ssm"
+)
+
+// storedJitConfig is JIT config found from the store
+type storedJitConfig struct {
+	reference string
+	created   time.Time
+}
+
+// jitConfigStore keeps JIT configs outside of task definition so that those are not visible in task descriptions
+type jitConfigStore interface {
+	// store saves JIT config and returns reference that runner can use to read it
+	store(ctx context.Context, name string, jitConfig string) (string, error)
+	read(ctx context.Context, reference string) (string, error)
+	remove(ctx context.Context, reference string) error
+	// list returns JIT configs having names starting with the prefix
+	list(ctx context.Context, prefix string) ([]storedJitConfig, error)
+}
+
+type secretsManagerClient interface {
+	CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	DeleteSecret(ctx context.Context, params *secretsmanager.DeleteSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error)
+	ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error)
+}
+
+type secretsManagerStore struct {
+	client secretsManagerClient
+}
+
+func (s *secretsManagerStore) store(ctx context.Context, name string, jitConfig string) (string, error) {
+	output, err := s.client.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		Description:  aws.String("Short-lived JIT config of GitHub Actions runner"),
+		SecretString: aws.String(jitConfig),
+	})
+	if err != nil {
+		return "", err
+	}
+	return *output.ARN, nil
+}
+
+func (s *secretsManagerStore) read(ctx context.Context, reference string) (string, error) {
+	output, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(reference),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.SecretString), nil
+}
+
+func (s *secretsManagerStore) remove(ctx context.Context, reference string) error {
+	_, err := s.client.DeleteSecret(ctx, &secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(reference),
+		ForceDeleteWithoutRecovery: aws.Bool(true),
+	})
+	return err
+}
+
+func (s *secretsManagerStore) list(ctx context.Context, prefix string) ([]storedJitConfig, error) {
+	var configs []storedJitConfig
+	// Name filter matches to the beginning of the name
+	paginator := secretsmanager.NewListSecretsPaginator(s.client, &secretsmanager.ListSecretsInput{
+		Filters: []smtypes.Filter{{Key: smtypes.FilterNameStringTypeName, Values: []string{prefix}}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return configs, err
+		}
+		for _, secret := range page.SecretList {
+			configs = append(configs, storedJitConfig{reference: aws.ToString(secret.ARN), created: aws.ToTime(secret.CreatedDate)})
+		}
+	}
+	return configs, nil
+}
+
+type ssmClient interface {
+	PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error)
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+	DeleteParameter(ctx context.Context, params *ssm.DeleteParameterInput, optFns ...func(*ssm.Options)) (*ssm.DeleteParameterOutput, error)
+	DescribeParameters(ctx context.Context, params *ssm.DescribeParametersInput, optFns ...func(*ssm.Options)) (*ssm.DescribeParametersOutput, error)
+}
+
+type ssmStore struct {
+	client ssmClient
+}
+
+func (s *ssmStore) store(ctx context.Context, name string, jitConfig string) (string, error) {
+	_, err := s.client.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:        aws.String(name),
+		Description: aws.String("Short-lived JIT config of GitHub Actions runner"),
+		Value:       aws.String(jitConfig),
+		Type:        ssmtypes.ParameterTypeSecureString,
+		// JIT config can exceed 4 KB limit of standard parameters
+		Tier: ssmtypes.ParameterTierIntelligentTiering,
+	})
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (s *ssmStore) read(ctx context.Context, reference string) (string, error) {
+	output, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(reference),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if output.Parameter == nil {
+		return "", fmt.Errorf("parameter %s has no value", reference)
+	}
+	return aws.ToString(output.Parameter.Value), nil
+}
+
+func (s *ssmStore) remove(ctx context.Context, reference string) error {
+	_, err := s.client.DeleteParameter(ctx, &ssm.DeleteParameterInput{
+		Name: aws.String(reference),
+	})
+	return err
+}
+
+func (s *ssmStore) list(ctx context.Context, prefix string) ([]storedJitConfig, error) {
+	var configs []storedJitConfig
+	paginator := ssm.NewDescribeParametersPaginator(s.client, &ssm.DescribeParametersInput{
+		ParameterFilters: []ssmtypes.ParameterStringFilter{{Key: aws.String("Name"), Option: aws.String("BeginsWith"), Values: []string{prefix}}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return configs, err
+		}
+		for _, parameter := range page.Parameters {
+			configs = append(configs, storedJitConfig{reference: aws.ToString(parameter.Name), created: aws.ToTime(parameter.LastModifiedDate)})
+		}
+	}
+	return configs, nil
+}
+
+func newJitConfigStore(kind string, cfg aws.Config) (jitConfigStore, error) {
+	switch kind {
+	case jitConfigStoreEnv:
+		return nil, nil
+	case jitConfigStoreSecretsManager:
+		return &secretsManagerStore{client: secretsmanager.NewFromConfig(cfg)}, nil
+	case jitConfigStoreSsm:
+		return &ssmStore{client: ssm.NewFromConfig(cfg)}, nil
+	default:
+		return nil, fmt.Errorf("unknown JIT_CONFIG_STORE %s, expected one of %s, %s or %s", kind, jitConfigStoreEnv, jitConfigStoreSecretsManager, jitConfigStoreSsm)
+	}
+}
+
+// removeExpiredJitConfigs removes JIT configs older than max age. Those are left when autoscaler was stopped while it was
+// waiting for the runner task.
+func removeExpiredJitConfigs(ctx context.Context, store jitConfigStore, prefix string, maxAge time.Duration) (removed int, err error) {
+	configs, err := store.list(ctx, prefix)
+	var errs []error
+	for _, stored := range configs {
+		if time.Since(stored.created) < maxAge {
+			continue
+		}
+		if removeErr := store.remove(ctx, stored.reference); removeErr != nil {
+			errs = append(errs, fmt.Errorf("could not remove JIT config %s: %w", stored.reference, removeErr))
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(append(errs, err)...)
+}
+
+// ReadJitConfig reads JIT config stored by autoscaler. Used by runner task to resolve ACTIONS_RUNNER_INPUT_JITCONFIG_REF.
+func ReadJitConfig(ctx context.Context, kind string, reference string) (string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	store, err := newJitConfigStore(kind, cfg)
+	if err != nil {
+		return "", err
+	}
+	if store == nil {
+		return "", fmt.Errorf("JIT config store %s doesn't hold references", kind)
+	}
+	return store.read(ctx, reference)
+}
@@ -0,0 +1,206 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+type fakeSecret struct {
+	name    string
+	value   string
+	created time.Time
+}
+
+// fakeSecretsManager keeps secrets in memory. Secrets are referenced by ARN as with Secrets Manager.
+type fakeSecretsManager struct {
+	secrets map[string]fakeSecret
+}
+
+func (f *fakeSecretsManager) CreateSecret(_ context.Context, params *secretsmanager.CreateSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error) {
+	arn := "arn:aws:secretsmanager:eu-north-1:123456789012:secret:" + aws.ToString(params.Name)
+	f.secrets[arn] = fakeSecret{name: aws.ToString(params.Name), value: aws.ToString(params.SecretString), created: time.Now()}
+	return &secretsmanager.CreateSecretOutput{ARN: aws.String(arn)}, nil
+}
+
+func (f *fakeSecretsManager) GetSecretValue(_ context.Context, params *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	secret, ok := f.secrets[aws.ToString(params.SecretId)]
+	if !ok {
+		return nil, &smtypes.ResourceNotFoundException{}
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(secret.value)}, nil
+}
+
+func (f *fakeSecretsManager) DeleteSecret(_ context.Context, params *secretsmanager.DeleteSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error) {
+	if !aws.ToBool(params.ForceDeleteWithoutRecovery) {
+		return nil, errors.New("secret would be kept for recovery")
+	}
+	if _, ok := f.secrets[aws.ToString(params.SecretId)]; !ok {
+		return nil, &smtypes.ResourceNotFoundException{}
+	}
+	delete(f.secrets, aws.ToString(params.SecretId))
+	return &secretsmanager.DeleteSecretOutput{}, nil
+}
+
+func (f *fakeSecretsManager) ListSecrets(_ context.Context, params *secretsmanager.ListSecretsInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error) {
+	output := &secretsmanager.ListSecretsOutput{}
+	for arn, secret := range f.secrets {
+		matches := true
+		for _, filter := range params.Filters {
+			if filter.Key == smtypes.FilterNameStringTypeName && !strings.HasPrefix(secret.name, filter.Values[0]) {
+				matches = false
+			}
+		}
+		if matches {
+			output.SecretList = append(output.SecretList, smtypes.SecretListEntry{ARN: aws.String(arn), Name: aws.String(secret.name), CreatedDate: aws.Time(secret.created)})
+		}
+	}
+	return output, nil
+}
+
+// fakeSsm keeps parameters in memory. Parameters are referenced by name.
+type fakeSsm struct {
+	parameters map[string]fakeSecret
+}
+
+func (f *fakeSsm) PutParameter(_ context.Context, params *ssm.PutParameterInput, _ ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	if params.Type != ssmtypes.ParameterTypeSecureString {
+		return nil, fmt.Errorf("parameter type %s is not encrypted", params.Type)
+	}
+	f.parameters[aws.ToString(params.Name)] = fakeSecret{name: aws.ToString(params.Name), value: aws.ToString(params.Value), created: time.Now()}
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func (f *fakeSsm) GetParameter(_ context.Context, params *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	parameter, ok := f.parameters[aws.ToString(params.Name)]
+	if !ok {
+		return nil, &ssmtypes.ParameterNotFound{}
+	}
+	value := parameter.value
+	if !aws.ToBool(params.WithDecryption) {
+		value = "encrypted"
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Name: params.Name, Value: aws.String(value)}}, nil
+}
+
+func (f *fakeSsm) DeleteParameter(_ context.Context, params *ssm.DeleteParameterInput, _ ...func(*ssm.Options)) (*ssm.DeleteParameterOutput, error) {
+	if _, ok := f.parameters[aws.ToString(params.Name)]; !ok {
+		return nil, &ssmtypes.ParameterNotFound{}
+	}
+	delete(f.parameters, aws.ToString(params.Name))
+	return &ssm.DeleteParameterOutput{}, nil
+}
+
+func (f *fakeSsm) DescribeParameters(_ context.Context, params *ssm.DescribeParametersInput, _ ...func(*ssm.Options)) (*ssm.DescribeParametersOutput, error) {
+	output := &ssm.DescribeParametersOutput{}
+	for name, parameter := range f.parameters {
+		matches := true
+		for _, filter := range params.ParameterFilters {
+			if aws.ToString(filter.Key) == "Name" && aws.ToString(filter.Option) == "BeginsWith" && !strings.HasPrefix(name, filter.Values[0]) {
+				matches = false
+			}
+		}
+		if matches {
+			output.Parameters = append(output.Parameters, ssmtypes.ParameterMetadata{Name: aws.String(name), LastModifiedDate: aws.Time(parameter.created)})
+		}
+	}
+	return output, nil
+}
+
+func TestJitConfigStores(t *testing.T) {
+	stores := map[string]jitConfigStore{
+		jitConfigStoreSecretsManager: &secretsManagerStore{client: &fakeSecretsManager{secrets: map[string]fakeSecret{}}},
+		jitConfigStoreSsm:            &ssmStore{client: &fakeSsm{parameters: map[string]fakeSecret{}}},
+	}
+	for kind, store := range stores {
+		t.Run(kind, func(t *testing.T) {
+			ctx := context.Background()
+			reference, err := store.store(ctx, "/gha-runner-jit/1-a", "jit-config-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.store(ctx, "/other/2-b", "jit-config-2"); err != nil {
+				t.Fatal(err)
+			}
+
+			jitConfig, err := store.read(ctx, reference)
+			if err != nil || jitConfig != "jit-config-1" {
+				t.Errorf("got JIT config %q and error %v", jitConfig, err)
+			}
+
+			listed, err := store.list(ctx, "/gha-runner-jit/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listed) != 1 || listed[0].reference != reference || time.Since(listed[0].created) > time.Minute {
+				t.Errorf("got JIT configs %+v, want only %s created now", listed, reference)
+			}
+
+			if err := store.remove(ctx, reference); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.read(ctx, reference); err == nil {
+				t.Error("removed JIT config can still be read")
+			}
+		})
+	}
+}
+
+// agedStore lists configs with given creation times, and fails removal of references in failing
+type agedStore struct {
+	jitConfigStore
+	configs []storedJitConfig
+	failing []string
+	removed []string
+}
+
+func (s *agedStore) list(context.Context, string) ([]storedJitConfig, error) {
+	return s.configs, nil
+}
+
+func (s *agedStore) remove(_ context.Context, reference string) error {
+	if slices.Contains(s.failing, reference) {
+		return errors.New("access denied")
+	}
+	s.removed = append(s.removed, reference)
+	return nil
+}
+
+func TestRemoveExpiredJitConfigs(t *testing.T) {
+	store := &agedStore{
+		configs: []storedJitConfig{
+			{reference: "new", created: time.Now().Add(-time.Hour)},
+			{reference: "old", created: time.Now().Add(-25 * time.Hour)},
+			{reference: "old-failing", created: time.Now().Add(-48 * time.Hour)},
+		},
+		failing: []string{"old-failing"},
+	}
+
+	removed, err := removeExpiredJitConfigs(context.Background(), store, "/gha-runner-jit/", jitConfigMaxAge)
+	if removed != 1 || !slices.Equal(store.removed, []string{"old"}) {
+		t.Errorf("removed %d configs %v, want only old", removed, store.removed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "old-failing") {
+		t.Errorf("got error %v, want failed removal to be reported", err)
+	}
+}
+
+func TestNewJitConfigStore(t *testing.T) {
+	store, err := newJitConfigStore(jitConfigStoreEnv, aws.Config{})
+	if store != nil || err != nil {
+		t.Errorf("env store got %v and error %v, want neither", store, err)
+	}
+	if _, err := newJitConfigStore("vault", aws.Config{}); err == nil {
+		t.Error("unknown store was accepted")
+	}
+}
@@ -6,20 +6,34 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"strconv"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/appcontainers/armappcontainers/v2"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/launch"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/reaper"
 )
 
 type Aca struct {
-	ctx               context.Context
-	logger            *slog.Logger
-	client            *armappcontainers.JobsClient
-	resourceGroupName string
-	jobName           string
+	ctx                 context.Context
+	logger              *slog.Logger
+	client              *armappcontainers.JobsClient
+	executionsClient    *armappcontainers.JobsExecutionsClient
+	reaper              *reaper.Policy
+	resourceGroupName   string
+	jobName             string
+	runnerContainerName string
+	profiles            []jobProfile
+	launch              launch.Settings
 }
 
+const startPollFrequency = 2 * time.Second
+
 func GetClient(ctx context.Context, logger *slog.Logger) (*Aca, error) {
 	subscriptionId, err1 := requireEnv("SUBSCRIPTION_ID")
 	resourceGroupName, err2 := requireEnv("RESOURCE_GROUP_NAME")
@@ -32,78 +46,348 @@ func GetClient(ctx context.Context, logger *slog.Logger) (*Aca, error) {
 	if err != nil {
 		return nil, err
 	}
-	client, err := armappcontainers.NewJobsClient(subscriptionId, cred, nil)
+	clientFactory, err := armappcontainers.NewClientFactory(subscriptionId, cred, nil)
+	if err != nil {
+		return nil, err
+	}
+	reaperPolicy, err := reaper.FromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Aca{
+	profiles, err := parseJobProfiles(os.Getenv("JOB_PROFILES"))
+	if err != nil {
+		return nil, err
+	}
+
+	launchSettings, err := launch.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	aca := &Aca{
 		ctx:               ctx,
 		logger:            logger,
-		client:            client,
+		client:            clientFactory.NewJobsClient(),
+		executionsClient:  clientFactory.NewJobsExecutionsClient(),
+		reaper:            reaperPolicy,
 		resourceGroupName: resourceGroupName,
 		jobName:           jobName,
-	}, nil
+		// Optional, first container of the job is used by default
+		runnerContainerName: os.Getenv("RUNNER_CONTAINER_NAME"),
+		profiles:            profiles,
+		launch:              launchSettings,
+	}
+
+	if err := aca.validateProfiles(); err != nil {
+		return nil, err
+	}
+
+	return aca, nil
 }
 
 func (a *Aca) CurrentRunnerCount() (int, error) {
 	return 0, fmt.Errorf("not implemented")
 }
 
-func (a *Aca) TriggerNewRunners(jitConfigs []string) (err error) {
-	jobDefinition, err := a.client.Get(a.ctx, a.resourceGroupName, a.jobName, nil)
+func (a *Aca) TriggerNewRunners(runners []github.RunnerRequest) (started []int64, err error) {
+	var errorSlice []error
+	var starts []executionStart
+	templates := map[string]*armappcontainers.JobTemplate{}
+
+	for _, runner := range runners {
+		profile := launch.MatchingProfile(a.profiles, runner.Labels, func(p jobProfile) string { return p.Label })
+		jobName := a.jobName
+		if profile != nil && len(profile.JobName) > 0 {
+			jobName = profile.JobName
+		}
+
+		template, found := templates[jobName]
+		if !found {
+			jobDefinition, err := a.client.Get(a.ctx, a.resourceGroupName, jobName, nil)
+			if err != nil {
+				errorSlice = append(errorSlice, err)
+				continue
+			}
+			template = jobTemplate(jobDefinition.Job)
+			templates[jobName] = template
+		}
+		runnerContainerName, err := a.runnerContainer(jobName, template)
+		if err != nil {
+			errorSlice = append(errorSlice, err)
+			continue
+		}
+
+		// Start API doesn't accept volumes nor volume mounts, so those can't be set per execution
+		executionTemplate := &armappcontainers.JobExecutionTemplate{}
+		for _, container := range template.InitContainers {
+			executionTemplate.InitContainers = append(executionTemplate.InitContainers, &armappcontainers.JobExecutionContainer{
+				Name:      container.Name,
+				Image:     container.Image,
+				Resources: container.Resources,
+				Command:   container.Command,
+				Args:      container.Args,
+				Env:       container.Env,
+			})
+		}
+		for _, container := range template.Containers {
+			env := container.Env
+			resources := container.Resources
+			if *container.Name == runnerContainerName {
+				env = runnerEnv(container.Env, runner)
+				if profile != nil && profile.hasResources() {
+					resources = profile.resources()
+				}
+			}
+			executionTemplate.Containers = append(executionTemplate.Containers, &armappcontainers.JobExecutionContainer{
+				Name:      container.Name,
+				Image:     container.Image,
+				Resources: resources,
+				Command:   container.Command,
+				Args:      container.Args,
+				Env:       env,
+			})
+		}
+
+		starts = append(starts, executionStart{
+			jobName:  jobName,
+			runner:   runner,
+			template: executionTemplate,
+		})
+	}
+
+	startErrors := a.launch.Run(len(starts), func(i int) error {
+		return a.startExecution(starts[i])
+	})
+
+	for i, start := range starts {
+		if startErrors[i] == nil {
+			started = append(started, start.runner.RequestId)
+		}
+	}
+	return started, errors.Join(append(errorSlice, startErrors...)...)
+}
+
+type executionStart struct {
+	jobName  string
+	runner   github.RunnerRequest
+	template *armappcontainers.JobExecutionTemplate
+}
+
+// startExecution starts the execution and waits until ACA has accepted it. Execution that is still starting after the timeout is considered launched.
+func (a *Aca) startExecution(start executionStart) error {
+	ctx, cancel := context.WithTimeout(a.ctx, a.launch.Timeout)
+	defer cancel()
+
+	poller, err := a.client.BeginStart(ctx, a.resourceGroupName, start.jobName, &armappcontainers.JobsClientBeginStartOptions{
+		Template: start.template,
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("starting execution of job %s for request %d failed: %w", start.jobName, start.runner.RequestId, err)
+	}
+	execution, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: startPollFrequency})
+	if err != nil && ctx.Err() != nil && a.ctx.Err() == nil {
+		// ACA accepted the execution, it's just slow to start
+		a.logger.Warn(fmt.Sprintf("Launched execution of job %s for request %d, not yet started after %s", start.jobName, start.runner.RequestId, a.launch.Timeout),
+			slog.Int64("requestId", start.runner.RequestId),
+			slog.String("job", start.jobName),
+		)
+		github.AddMetric(github.MetricExecutionsNotYetStarted, 1)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("execution of job %s for request %d didn't start: %w", start.jobName, start.runner.RequestId, err)
 	}
-	// Append JIT key to environment variables
-	container := jobDefinition.Properties.Template.Containers[0]
 
-	env := []*armappcontainers.EnvironmentVar{}
+	var executionName string
+	if execution.Name != nil {
+		executionName = *execution.Name
+	}
+	a.logger.Info(fmt.Sprintf("Started execution %s for request %d", executionName, start.runner.RequestId),
+		slog.Int64("requestId", start.runner.RequestId),
+		slog.String("job", start.jobName),
+		slog.String("execution", executionName),
+	)
+	github.AddMetric(github.MetricExecutionsStarted, 1)
+	return nil
+}
 
-	for _, envVar := range container.Env {
-		if *envVar.Name != "ACTIONS_RUNNER_INPUT_JITCONFIG" {
-			env = append(env, envVar)
+// jobTemplate returns template of the job, or nil if the job has none
+func jobTemplate(job armappcontainers.Job) *armappcontainers.JobTemplate {
+	if job.Properties == nil {
+		return nil
+	}
+	return job.Properties.Template
+}
+
+// runnerContainer returns name of the container that gets the JIT config. First container is used if not configured.
+// Containers are copied to executions by name, so every container of the job has to have one.
+func (a *Aca) runnerContainer(jobName string, template *armappcontainers.JobTemplate) (string, error) {
+	if template == nil || len(template.Containers) == 0 {
+		return "", fmt.Errorf("job %s doesn't have any containers", jobName)
+	}
+	for i, container := range template.Containers {
+		if container.Name == nil {
+			return "", fmt.Errorf("container %d of job %s doesn't have name", i, jobName)
 		}
 	}
+	if a.runnerContainerName == "" {
+		return *template.Containers[0].Name, nil
+	}
+	for _, container := range template.Containers {
+		if *container.Name == a.runnerContainerName {
+			return a.runnerContainerName, nil
+		}
+	}
+	return "", fmt.Errorf("job %s doesn't have container %s", jobName, a.runnerContainerName)
+}
 
-	var errorSlice []error
+// validateProfiles checks that jobs of the profiles exist, have the runner container, and that resources requested by the
+// profiles fit their workload profiles
+func (a *Aca) validateProfiles() error {
+	var errs []error
+	jobs := map[string]*armappcontainers.Job{}
+	for _, jobName := range a.jobNames() {
+		jobDefinition, err := a.client.Get(a.ctx, a.resourceGroupName, jobName, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := a.runnerContainer(jobName, jobTemplate(jobDefinition.Job)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		jobs[jobName] = &jobDefinition.Job
+	}
 
-	for _, jitConfig := range jitConfigs {
+	for _, profile := range a.profiles {
+		jobName := a.jobName
+		if len(profile.JobName) > 0 {
+			jobName = profile.JobName
+		}
+		job, found := jobs[jobName]
+		if !found {
+			continue
+		}
+		var workloadProfileName string
+		if job.Properties.WorkloadProfileName != nil {
+			workloadProfileName = *job.Properties.WorkloadProfileName
+		}
+		runnerContainerName, _ := a.runnerContainer(jobName, job.Properties.Template)
+		errs = append(errs, profile.validate(workloadProfileName, job.Properties.Template, runnerContainerName))
+	}
+	return errors.Join(errs...)
+}
 
-		var jobStartOptions = &armappcontainers.JobsClientBeginStartOptions{
-			Template: &armappcontainers.JobExecutionTemplate{
-				Containers: []*armappcontainers.JobExecutionContainer{
-					{
-						Name:      container.Name,
-						Image:     container.Image,
-						Resources: container.Resources,
-						Command:   container.Command,
-						Args:      container.Args,
-						Env: append(
-							env,
-							&armappcontainers.EnvironmentVar{
-								Name:  to.Ptr("ACTIONS_RUNNER_INPUT_JITCONFIG"),
-								Value: &jitConfig,
-							},
-						),
-					},
-				},
-			},
+// jobNames returns all jobs the autoscaler may start executions of
+func (a *Aca) jobNames() []string {
+	jobNames := []string{a.jobName}
+	for _, profile := range a.profiles {
+		if len(profile.JobName) > 0 && !slices.Contains(jobNames, profile.JobName) {
+			jobNames = append(jobNames, profile.JobName)
 		}
+	}
+	return jobNames
+}
 
-		_, err = a.client.BeginStart(a.ctx, a.resourceGroupName, a.jobName, jobStartOptions)
+// runnerEnv appends JIT config and request ID of the runner to environment variables of the container
+func runnerEnv(containerEnv []*armappcontainers.EnvironmentVar, runner github.RunnerRequest) []*armappcontainers.EnvironmentVar {
+	env := []*armappcontainers.EnvironmentVar{}
 
-		errorSlice = append(errorSlice, err)
+	for _, envVar := range containerEnv {
+		if *envVar.Name != "ACTIONS_RUNNER_INPUT_JITCONFIG" && *envVar.Name != reaper.RequestIdEnv {
+			env = append(env, envVar)
+		}
 	}
 
-	return errors.Join(errorSlice...)
+	return append(
+		env,
+		&armappcontainers.EnvironmentVar{
+			Name:  to.Ptr("ACTIONS_RUNNER_INPUT_JITCONFIG"),
+			Value: to.Ptr(runner.JitConfig),
+		},
+		&armappcontainers.EnvironmentVar{
+			Name:  to.Ptr(reaper.RequestIdEnv),
+			Value: to.Ptr(strconv.FormatInt(runner.RequestId, 10)),
+		},
+	)
 }
 
-func (a *Aca) NeededRunners(jitConfigs []string) (err error) {
+func (a *Aca) NeededRunners(runners []github.RunnerRequest) (err error) {
 	return fmt.Errorf("not implemented")
 
 }
 
+func (a *Aca) StartReaper() {
+	a.reaper.Run(a.ctx, a.logger, a.reapExecutions)
+}
+
+func (a *Aca) CancelRunnerRequest(requestId int64) {
+	a.reaper.Cancel(requestId)
+}
+
+func (a *Aca) reapExecutions() error {
+	var errs []error
+	for _, jobName := range a.jobNames() {
+		errs = append(errs, a.reapJobExecutions(jobName))
+	}
+	return errors.Join(errs...)
+}
+
+func (a *Aca) reapJobExecutions(jobName string) error {
+	var errs []error
+	pager := a.executionsClient.NewListPager(a.resourceGroupName, jobName, nil)
+	for pager.More() {
+		page, err := pager.NextPage(a.ctx)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		for _, execution := range page.Value {
+			if execution.Status == nil || execution.Name == nil {
+				continue
+			}
+			if *execution.Status != armappcontainers.JobExecutionRunningStateRunning && *execution.Status != armappcontainers.JobExecutionRunningStateProcessing {
+				continue
+			}
+			requestId, found := executionRequestId(execution)
+			if !found {
+				// Not started by the autoscaler
+				continue
+			}
+			var startTime time.Time
+			if execution.StartTime != nil {
+				startTime = *execution.StartTime
+			}
+			reason := a.reaper.Reason(requestId, startTime)
+			if reason == "" {
+				continue
+			}
+			a.logger.Info(fmt.Sprintf("Stopping execution %s of request %d: %s", *execution.Name, requestId, reason))
+			_, err := a.client.BeginStopExecution(a.ctx, a.resourceGroupName, jobName, *execution.Name, nil)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			a.reaper.Forget(requestId)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func executionRequestId(execution *armappcontainers.JobExecution) (int64, bool) {
+	if execution.Template == nil {
+		return 0, false
+	}
+	for _, container := range execution.Template.Containers {
+		for _, envVar := range container.Env {
+			if envVar.Name != nil && *envVar.Name == reaper.RequestIdEnv && envVar.Value != nil {
+				return reaper.RequestId(*envVar.Value)
+			}
+		}
+	}
+	return 0, false
+}
+
 func requireEnv(key string) (value string, err error) {
 	value = os.Getenv(key)
 	if len(value) == 0 {
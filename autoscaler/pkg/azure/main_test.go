@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/appcontainers/armappcontainers/v2"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/reaper"
+)
+
+func TestExecutionRequestId(t *testing.T) {
+	tests := []struct {
+		name      string
+		execution *armappcontainers.JobExecution
+		want      int64
+		wantFound bool
+	}{
+		{name: "no template", execution: &armappcontainers.JobExecution{}},
+		{
+			name: "request ID in runner container",
+			execution: &armappcontainers.JobExecution{Template: &armappcontainers.JobExecutionTemplate{Containers: []*armappcontainers.JobExecutionContainer{
+				{Env: []*armappcontainers.EnvironmentVar{{Name: to.Ptr("OTHER"), Value: to.Ptr("1")}}},
+				{Env: []*armappcontainers.EnvironmentVar{{Name: to.Ptr(reaper.RequestIdEnv), Value: to.Ptr("42")}}},
+			}}},
+			want:      42,
+			wantFound: true,
+		},
+		{
+			name: "not started by autoscaler",
+			execution: &armappcontainers.JobExecution{Template: &armappcontainers.JobExecutionTemplate{Containers: []*armappcontainers.JobExecutionContainer{
+				{Env: []*armappcontainers.EnvironmentVar{{Name: to.Ptr("OTHER"), Value: to.Ptr("1")}}},
+			}}},
+		},
+		{
+			name: "request ID from secret",
+			execution: &armappcontainers.JobExecution{Template: &armappcontainers.JobExecutionTemplate{Containers: []*armappcontainers.JobExecutionContainer{
+				{Env: []*armappcontainers.EnvironmentVar{{Name: to.Ptr(reaper.RequestIdEnv), SecretRef: to.Ptr("request-id")}}},
+			}}},
+		},
+		{
+			name: "invalid request ID",
+			execution: &armappcontainers.JobExecution{Template: &armappcontainers.JobExecutionTemplate{Containers: []*armappcontainers.JobExecutionContainer{
+				{Env: []*armappcontainers.EnvironmentVar{{Name: to.Ptr(reaper.RequestIdEnv), Value: to.Ptr("abc")}}},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestId, found := executionRequestId(tt.execution)
+			if requestId != tt.want || found != tt.wantFound {
+				t.Errorf("got %d and %t, want %d and %t", requestId, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestRunnerContainer(t *testing.T) {
+	template := &armappcontainers.JobTemplate{Containers: []*armappcontainers.Container{{Name: to.Ptr("runner")}, {Name: to.Ptr("docker")}}}
+
+	tests := []struct {
+		name          string
+		containerName string
+		template      *armappcontainers.JobTemplate
+		want          string
+		wantErr       string
+	}{
+		{name: "first container by default", template: template, want: "runner"},
+		{name: "configured container", containerName: "docker", template: template, want: "docker"},
+		{name: "missing container", containerName: "dind", template: template, wantErr: "doesn't have container dind"},
+		{name: "no template", wantErr: "doesn't have any containers"},
+		{name: "no containers", template: &armappcontainers.JobTemplate{}, wantErr: "doesn't have any containers"},
+		{
+			name:     "container without name",
+			template: &armappcontainers.JobTemplate{Containers: []*armappcontainers.Container{{Name: to.Ptr("runner")}, {Image: to.Ptr("docker:dind")}}},
+			wantErr:  "container 1 of job runner-job doesn't have name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Aca{runnerContainerName: tt.containerName}
+			name, err := a.runnerContainer("runner-job", tt.template)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %q and error %v, want %q", name, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || name != tt.want {
+				t.Errorf("got %q and error %v, want %q", name, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package azure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/appcontainers/armappcontainers/v2"
+)
+
+// Consumption workload profile allows 0.25-4 vCPU in 0.25 steps, with 2 GiB of memory per vCPU. Consumption-only
+// environment, where job has no workload profile, allows at most 2 vCPU.
+const (
+	consumptionMinCpu     = 0.25
+	consumptionMaxCpu     = 4.0
+	consumptionOnlyMaxCpu = 2.0
+	consumptionCpuStep    = 0.25
+)
+
+// jobProfile selects ACA job and/or resources of the runner container for jobs requesting the label
+type jobProfile struct {
+	Label   string  `json:"label"`
+	JobName string  `json:"jobName,omitempty"`
+	Cpu     float64 `json:"cpu,omitempty"`
+	Memory  string  `json:"memory,omitempty"`
+}
+
+func parseJobProfiles(value string) ([]jobProfile, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	var profiles []jobProfile
+	if err := json.Unmarshal([]byte(value), &profiles); err != nil {
+		return nil, fmt.Errorf("invalid JOB_PROFILES: %w", err)
+	}
+	var errs []error
+	for _, profile := range profiles {
+		if len(profile.Label) == 0 {
+			errs = append(errs, fmt.Errorf("profile %+v doesn't have label", profile))
+		}
+		if len(profile.JobName) == 0 && !profile.hasResources() {
+			errs = append(errs, fmt.Errorf("profile %s defines neither job name nor resources", profile.Label))
+		}
+	}
+	return profiles, errors.Join(errs...)
+}
+
+func (p jobProfile) hasResources() bool {
+	return p.Cpu != 0 || len(p.Memory) > 0
+}
+
+// validate checks that resources of the profile are allowed in workload profile of the job. Runner container gets
+// resources of the profile, and in Consumption profile total over all containers of the job has to be allowed.
+func (p jobProfile) validate(workloadProfileName string, template *armappcontainers.JobTemplate, runnerContainerName string) error {
+	if !p.hasResources() {
+		return nil
+	}
+	if p.Cpu <= 0 || len(p.Memory) == 0 {
+		return fmt.Errorf("profile %s has to define both cpu and memory", p.Label)
+	}
+	maxCpu := consumptionMaxCpu
+	switch workloadProfileName {
+	case "":
+		maxCpu = consumptionOnlyMaxCpu
+	case "Consumption":
+	default:
+		// Limits of dedicated profiles depend on the profile type, so leaving validation to ACA
+		return nil
+	}
+	memory, err := parseGi(p.Memory)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", p.Label, err)
+	}
+	cpu := p.Cpu
+	for _, container := range template.Containers {
+		var name string
+		if container.Name != nil {
+			name = *container.Name
+		}
+		if name == runnerContainerName || container.Resources == nil {
+			continue
+		}
+		if container.Resources.CPU != nil {
+			cpu += *container.Resources.CPU
+		}
+		if container.Resources.Memory != nil {
+			containerMemory, err := parseGi(*container.Resources.Memory)
+			if err != nil {
+				return fmt.Errorf("profile %s: container %s: %w", p.Label, name, err)
+			}
+			memory += containerMemory
+		}
+	}
+	if cpu < consumptionMinCpu || cpu > maxCpu || math.Mod(cpu, consumptionCpuStep) != 0 {
+		return fmt.Errorf("profile %s: total cpu %g of the containers not allowed in Consumption profile, has to be %g-%g in steps of %g", p.Label, cpu, consumptionMinCpu, maxCpu, consumptionCpuStep)
+	}
+	if memory != cpu*2 {
+		return fmt.Errorf("profile %s: total memory %gGi of the containers not allowed in Consumption profile with total cpu %g, has to be %gGi", p.Label, memory, cpu, cpu*2)
+	}
+	return nil
+}
+
+func parseGi(memory string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSuffix(memory, "Gi"), 64)
+	if err != nil || !strings.HasSuffix(memory, "Gi") {
+		return 0, fmt.Errorf("memory %s has to be given in Gi", memory)
+	}
+	return value, nil
+}
+
+func (p jobProfile) resources() *armappcontainers.ContainerResources {
+	return &armappcontainers.ContainerResources{
+		CPU:    to.Ptr(p.Cpu),
+		Memory: to.Ptr(p.Memory),
+	}
+}
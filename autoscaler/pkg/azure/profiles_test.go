@@ -0,0 +1,118 @@
+package azure
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/appcontainers/armappcontainers/v2"
+)
+
+func TestParseJobProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []jobProfile
+		wantErr []string
+	}{
+		{name: "not set"},
+		{
+			name:  "job and resources",
+			value: `[{"label": "kaniko", "jobName": "kaniko-runner-job"}, {"label": "large", "cpu": 4, "memory": "8Gi"}]`,
+			want:  []jobProfile{{Label: "kaniko", JobName: "kaniko-runner-job"}, {Label: "large", Cpu: 4, Memory: "8Gi"}},
+		},
+		{name: "invalid JSON", value: `[{"label": `, wantErr: []string{"invalid JOB_PROFILES"}},
+		{
+			name:    "all problems are reported",
+			value:   `[{"jobName": "other"}, {"label": "empty"}]`,
+			wantErr: []string{"doesn't have label", "profile empty defines neither job name nor resources"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profiles, err := parseJobProfiles(tt.value)
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("invalid profiles were accepted")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q doesn't contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(profiles, tt.want) {
+				t.Errorf("got %+v and error %v, want %+v", profiles, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	runnerOnly := &armappcontainers.JobTemplate{Containers: []*armappcontainers.Container{
+		{Name: to.Ptr("runner"), Resources: &armappcontainers.ContainerResources{CPU: to.Ptr(0.5), Memory: to.Ptr("1Gi")}},
+	}}
+	withSidecar := &armappcontainers.JobTemplate{Containers: []*armappcontainers.Container{
+		{Name: to.Ptr("runner"), Resources: &armappcontainers.ContainerResources{CPU: to.Ptr(0.5), Memory: to.Ptr("1Gi")}},
+		{Name: to.Ptr("docker"), Resources: &armappcontainers.ContainerResources{CPU: to.Ptr(1.0), Memory: to.Ptr("2Gi")}},
+	}}
+
+	tests := []struct {
+		name            string
+		profile         jobProfile
+		workloadProfile string
+		template        *armappcontainers.JobTemplate
+		wantErr         string
+	}{
+		{name: "job only", profile: jobProfile{Label: "kaniko", JobName: "kaniko-runner-job"}, template: runnerOnly},
+		{name: "cpu without memory", profile: jobProfile{Label: "large", Cpu: 2}, template: runnerOnly, wantErr: "both cpu and memory"},
+		{name: "allowed in Consumption profile", profile: jobProfile{Label: "large", Cpu: 4, Memory: "8Gi"}, workloadProfile: "Consumption", template: runnerOnly},
+		{name: "too much cpu for Consumption profile", profile: jobProfile{Label: "large", Cpu: 4.5, Memory: "9Gi"}, workloadProfile: "Consumption", template: runnerOnly, wantErr: "has to be 0.25-4 in steps of 0.25"},
+		{name: "allowed in consumption-only environment", profile: jobProfile{Label: "large", Cpu: 2, Memory: "4Gi"}, template: runnerOnly},
+		{name: "too much cpu for consumption-only environment", profile: jobProfile{Label: "large", Cpu: 4, Memory: "8Gi"}, template: runnerOnly, wantErr: "has to be 0.25-2 in steps of 0.25"},
+		{name: "cpu not in steps", profile: jobProfile{Label: "odd", Cpu: 0.3, Memory: "0.6Gi"}, workloadProfile: "Consumption", template: runnerOnly, wantErr: "in steps of 0.25"},
+		{name: "memory not twice the cpu", profile: jobProfile{Label: "large", Cpu: 1, Memory: "4Gi"}, workloadProfile: "Consumption", template: runnerOnly, wantErr: "has to be 2Gi"},
+		{name: "other containers are summed", profile: jobProfile{Label: "large", Cpu: 3, Memory: "6Gi"}, workloadProfile: "Consumption", template: withSidecar},
+		{name: "sum of containers too large", profile: jobProfile{Label: "large", Cpu: 3.5, Memory: "7Gi"}, workloadProfile: "Consumption", template: withSidecar, wantErr: "total cpu 4.5"},
+		{name: "dedicated profile is left to ACA", profile: jobProfile{Label: "large", Cpu: 16, Memory: "64Gi"}, workloadProfile: "D16", template: runnerOnly},
+		{name: "memory not in Gi", profile: jobProfile{Label: "large", Cpu: 1, Memory: "2048Mi"}, workloadProfile: "Consumption", template: runnerOnly, wantErr: "has to be given in Gi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.profile.validate(tt.workloadProfile, tt.template, "runner")
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("valid profile was refused: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseGi(t *testing.T) {
+	tests := []struct {
+		memory  string
+		want    float64
+		wantErr bool
+	}{
+		{memory: "4Gi", want: 4},
+		{memory: "0.5Gi", want: 0.5},
+		{memory: "512Mi", wantErr: true},
+		{memory: "4", wantErr: true},
+		{memory: "Gi", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.memory, func(t *testing.T) {
+			memory, err := parseGi(tt.memory)
+			if (err != nil) != tt.wantErr || memory != tt.want {
+				t.Errorf("got %g and error %v, want %g", memory, err, tt.want)
+			}
+		})
+	}
+}
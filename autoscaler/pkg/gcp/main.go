@@ -6,20 +6,35 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	run "cloud.google.com/go/run/apiv2"
 	"cloud.google.com/go/run/apiv2/runpb"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/launch"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/reaper"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
 )
 
 type Cr struct {
-	ctx       context.Context
-	logger    *slog.Logger
-	client    *run.JobsClient
-	jobName   string
-	projectId string
+	ctx              context.Context
+	logger           *slog.Logger
+	client           *run.JobsClient
+	executionsClient *run.ExecutionsClient
+	reaper           *reaper.Policy
+	jobName          string
+	projectId        string
+	profiles         []runProfile
+	launch           launch.Settings
+	runnerContainer  string
 }
 
+const startPollFrequency = 2 * time.Second
+
 func GetClient(ctx context.Context, logger *slog.Logger) (*Cr, error) {
 	jobName, err1 := requireEnv("JOB_NAME")
 
@@ -33,17 +48,53 @@ func GetClient(ctx context.Context, logger *slog.Logger) (*Cr, error) {
 		return nil, err
 	}
 
+	projectId := getenv("PROJECT_ID", credentials.ProjectID)
+	jobName, err = qualifiedJobName(jobName, projectId, os.Getenv("REGION"))
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := parseRunProfiles(os.Getenv("JOB_PROFILES"))
+	if err != nil {
+		return nil, err
+	}
+
 	client, err := run.NewJobsClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	executionsClient, err := run.NewExecutionsClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reaperPolicy, err := reaper.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	launchSettings, err := launch.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	runnerContainerName, err := runnerContainer(ctx, client, jobName, os.Getenv("RUNNER_CONTAINER_NAME"))
+	if err != nil {
+		return nil, err
+	}
+
 	return &Cr{
-		ctx:       ctx,
-		logger:    logger,
-		client:    client,
-		jobName:   jobName,
-		projectId: credentials.ProjectID,
+		ctx:              ctx,
+		logger:           logger,
+		client:           client,
+		executionsClient: executionsClient,
+		reaper:           reaperPolicy,
+		jobName:          jobName,
+		projectId:        projectId,
+		profiles:         profiles,
+		launch:           launchSettings,
+		runnerContainer:  runnerContainerName,
 	}, nil
 }
 
@@ -51,41 +102,219 @@ func (c *Cr) CurrentRunnerCount() (int, error) {
 	return 0, fmt.Errorf("not implemented")
 }
 
-func (c *Cr) TriggerNewRunners(jitConfigs []string) (err error) {
-	var errorSlice []error
-
-	for _, jitConfig := range jitConfigs {
+func (c *Cr) TriggerNewRunners(runners []github.RunnerRequest) (started []int64, err error) {
+	var requests []*runpb.RunJobRequest
 
-		req := &runpb.RunJobRequest{
-			Name: c.jobName,
-			Overrides: &runpb.RunJobRequest_Overrides{
-				ContainerOverrides: []*runpb.RunJobRequest_Overrides_ContainerOverride{
-					{
-						Env: []*runpb.EnvVar{
-							{
-								Name:   "ACTIONS_RUNNER_INPUT_JITCONFIG",
-								Values: &runpb.EnvVar_Value{Value: jitConfig},
-							},
-						},
-					},
+	for _, runner := range runners {
+		containerOverride := &runpb.RunJobRequest_Overrides_ContainerOverride{
+			Name: c.runnerContainer,
+			Env: []*runpb.EnvVar{
+				{
+					Name:   "ACTIONS_RUNNER_INPUT_JITCONFIG",
+					Values: &runpb.EnvVar_Value{Value: runner.JitConfig},
+				},
+				{
+					Name:   reaper.RequestIdEnv,
+					Values: &runpb.EnvVar_Value{Value: strconv.FormatInt(runner.RequestId, 10)},
 				},
 			},
 		}
+		overrides := &runpb.RunJobRequest_Overrides{
+			ContainerOverrides: []*runpb.RunJobRequest_Overrides_ContainerOverride{containerOverride},
+		}
+		launch.MatchingProfile(c.profiles, runner.Labels, func(p runProfile) string { return p.Label }).apply(overrides, containerOverride)
 
-		_, err = c.client.RunJob(c.ctx, req)
+		requests = append(requests, &runpb.RunJobRequest{
+			Name:      c.jobName,
+			Overrides: overrides,
+		})
+	}
 
-		errorSlice = append(errorSlice, err)
+	errorSlice := c.launch.Run(len(requests), func(i int) error {
+		return c.runExecution(requests[i], runners[i].RequestId)
+	})
 
+	for i, runner := range runners {
+		if errorSlice[i] == nil {
+			started = append(started, runner.RequestId)
+		}
 	}
+	return started, errors.Join(errorSlice...)
+}
+
+// runExecution runs the job and waits until its execution has started or failed to launch, at most start timeout.
+// Completion of the execution is not awaited.
+func (c *Cr) runExecution(req *runpb.RunJobRequest, requestId int64) error {
+	ctx, cancel := context.WithTimeout(c.ctx, c.launch.Timeout)
+	defer cancel()
 
-	return errors.Join(errorSlice...)
+	op, err := c.client.RunJob(ctx, req)
+	if err != nil {
+		return fmt.Errorf("running job for request %d failed: %w", requestId, err)
+	}
+
+	for {
+		execution, err := op.Metadata()
+		if err == nil && execution != nil {
+			for _, condition := range execution.Conditions {
+				if condition.GetState() == runpb.Condition_CONDITION_FAILED {
+					return fmt.Errorf("execution %s for request %d failed to launch: %s %s", execution.Name, requestId, condition.GetType(), condition.GetMessage())
+				}
+			}
+			if execution.StartTime != nil {
+				c.logger.Info(fmt.Sprintf("Started execution %s for request %d", execution.Name, requestId),
+					slog.Int64("requestId", requestId),
+					slog.String("execution", execution.Name),
+				)
+				github.AddMetric(github.MetricExecutionsStarted, 1)
+				return nil
+			}
+		}
+		if op.Done() {
+			// Execution has already completed, which is fine as long as operation didn't fail
+			_, err = op.Poll(ctx)
+			if err != nil {
+				return fmt.Errorf("execution for request %d failed: %w", requestId, err)
+			}
+			github.AddMetric(github.MetricExecutionsStarted, 1)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return c.launchedNotStarted(requestId)
+		case <-time.After(startPollFrequency):
+		}
+		if _, err := op.Poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return c.launchedNotStarted(requestId)
+			}
+			return fmt.Errorf("execution for request %d failed: %w", requestId, err)
+		}
+	}
 }
 
-func (c *Cr) NeededRunners(jitConfigs []string) (err error) {
+// launchedNotStarted is called when start timeout expires after Cloud Run has accepted the run
+func (c *Cr) launchedNotStarted(requestId int64) error {
+	if c.ctx.Err() != nil {
+		return fmt.Errorf("execution for request %d didn't start before shutdown: %w", requestId, c.ctx.Err())
+	}
+	github.AddMetric(github.MetricExecutionsNotYetStarted, 1)
+	c.logger.Warn(fmt.Sprintf("Launched execution for request %d, not yet started after %s", requestId, c.launch.Timeout),
+		slog.Int64("requestId", requestId),
+	)
+	return nil
+}
+
+func (c *Cr) NeededRunners(runners []github.RunnerRequest) (err error) {
 	return fmt.Errorf("not implemented")
 
 }
 
+func (c *Cr) StartReaper() {
+	c.reaper.Run(c.ctx, c.logger, c.reapExecutions)
+}
+
+func (c *Cr) CancelRunnerRequest(requestId int64) {
+	c.reaper.Cancel(requestId)
+}
+
+func (c *Cr) reapExecutions() error {
+	var errs []error
+	executions := c.executionsClient.ListExecutions(c.ctx, &runpb.ListExecutionsRequest{Parent: c.jobName})
+	for {
+		execution, err := executions.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if execution.CompletionTime != nil {
+			continue
+		}
+		requestId, found := executionRequestId(execution)
+		if !found {
+			// Not started by the autoscaler
+			continue
+		}
+		var startTime time.Time
+		if execution.StartTime != nil {
+			startTime = execution.StartTime.AsTime()
+		}
+		reason := c.reaper.Reason(requestId, startTime)
+		if reason == "" {
+			continue
+		}
+		c.logger.Info(fmt.Sprintf("Cancelling execution %s of request %d: %s", execution.Name, requestId, reason))
+		_, err = c.executionsClient.CancelExecution(c.ctx, &runpb.CancelExecutionRequest{Name: execution.Name})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.reaper.Forget(requestId)
+	}
+	return errors.Join(errs...)
+}
+
+func executionRequestId(execution *runpb.Execution) (int64, bool) {
+	if execution.Template == nil {
+		return 0, false
+	}
+	for _, container := range execution.Template.Containers {
+		for _, envVar := range container.Env {
+			if envVar.Name == reaper.RequestIdEnv {
+				return reaper.RequestId(envVar.GetValue())
+			}
+		}
+	}
+	return 0, false
+}
+
+// jobGetter is the part of run.JobsClient needed to check the job at startup
+type jobGetter interface {
+	GetJob(ctx context.Context, req *runpb.GetJobRequest, opts ...gax.CallOption) (*runpb.Job, error)
+}
+
+// runnerContainer checks that the job has container for the runner. Name can be omitted if job has only one container.
+func runnerContainer(ctx context.Context, client jobGetter, jobName string, containerName string) (string, error) {
+	job, err := client.GetJob(ctx, &runpb.GetJobRequest{Name: jobName})
+	if err != nil {
+		return "", fmt.Errorf("could not get job %s: %w", jobName, err)
+	}
+	containers := job.GetTemplate().GetTemplate().GetContainers()
+	if len(containerName) == 0 {
+		if len(containers) != 1 {
+			return "", fmt.Errorf("job %s has %d containers, RUNNER_CONTAINER_NAME has to be set", jobName, len(containers))
+		}
+		return containers[0].Name, nil
+	}
+	for _, container := range containers {
+		if container.Name == containerName {
+			return containerName, nil
+		}
+	}
+	return "", fmt.Errorf("job %s doesn't have container %s", jobName, containerName)
+}
+
+// qualifiedJobName returns full resource name of the job. Already qualified names are returned as is.
+func qualifiedJobName(jobName string, projectId string, region string) (string, error) {
+	if strings.HasPrefix(jobName, "projects/") {
+		return jobName, nil
+	}
+	var errs []error
+	if len(projectId) == 0 {
+		errs = append(errs, fmt.Errorf("project couldn't be resolved from credentials, PROJECT_ID has to be set"))
+	}
+	if len(region) == 0 {
+		errs = append(errs, fmt.Errorf("value required for environment variable REGION"))
+	}
+	if len(errs) > 0 {
+		return "", errors.Join(errs...)
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/jobs/%s", projectId, region, jobName), nil
+}
+
 func requireEnv(key string) (value string, err error) {
 	value = os.Getenv(key)
 	if len(value) == 0 {
@@ -93,3 +322,11 @@ func requireEnv(key string) (value string, err error) {
 	}
 	return
 }
+
+func getenv(key, fallback string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,154 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/reaper"
+)
+
+func TestExecutionRequestId(t *testing.T) {
+	tests := []struct {
+		name      string
+		execution *runpb.Execution
+		want      int64
+		wantFound bool
+	}{
+		{name: "no template", execution: &runpb.Execution{}},
+		{
+			name: "request ID in runner container",
+			execution: &runpb.Execution{Template: &runpb.TaskTemplate{Containers: []*runpb.Container{
+				{Env: []*runpb.EnvVar{{Name: "OTHER", Values: &runpb.EnvVar_Value{Value: "1"}}}},
+				{Env: []*runpb.EnvVar{{Name: reaper.RequestIdEnv, Values: &runpb.EnvVar_Value{Value: "42"}}}},
+			}}},
+			want:      42,
+			wantFound: true,
+		},
+		{
+			name: "not started by autoscaler",
+			execution: &runpb.Execution{Template: &runpb.TaskTemplate{Containers: []*runpb.Container{
+				{Env: []*runpb.EnvVar{{Name: "OTHER", Values: &runpb.EnvVar_Value{Value: "1"}}}},
+			}}},
+		},
+		{
+			name: "invalid request ID",
+			execution: &runpb.Execution{Template: &runpb.TaskTemplate{Containers: []*runpb.Container{
+				{Env: []*runpb.EnvVar{{Name: reaper.RequestIdEnv, Values: &runpb.EnvVar_Value{Value: "abc"}}}},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestId, found := executionRequestId(tt.execution)
+			if requestId != tt.want || found != tt.wantFound {
+				t.Errorf("got %d and %t, want %d and %t", requestId, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestQualifiedJobName(t *testing.T) {
+	tests := []struct {
+		name      string
+		jobName   string
+		projectId string
+		region    string
+		want      string
+		wantErr   []string
+	}{
+		{name: "short name", jobName: "runner", projectId: "project", region: "europe-north1", want: "projects/project/locations/europe-north1/jobs/runner"},
+		{name: "qualified name", jobName: "projects/other/locations/us-central1/jobs/runner", want: "projects/other/locations/us-central1/jobs/runner"},
+		{name: "project missing", jobName: "runner", region: "europe-north1", wantErr: []string{"PROJECT_ID has to be set"}},
+		{name: "project and region missing", jobName: "runner", wantErr: []string{"PROJECT_ID has to be set", "REGION"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobName, err := qualifiedJobName(tt.jobName, tt.projectId, tt.region)
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatalf("got %s, want error", jobName)
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q doesn't contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil || jobName != tt.want {
+				t.Errorf("got %s and error %v, want %s", jobName, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProjectIdOverride(t *testing.T) {
+	t.Setenv("PROJECT_ID", "")
+	if projectId := getenv("PROJECT_ID", "from-credentials"); projectId != "from-credentials" {
+		t.Errorf("got project %s, want one of credentials", projectId)
+	}
+	t.Setenv("PROJECT_ID", "override")
+	if projectId := getenv("PROJECT_ID", "from-credentials"); projectId != "override" {
+		t.Errorf("got project %s, want PROJECT_ID", projectId)
+	}
+}
+
+// fakeJobs returns the job, or error if it's set
+type fakeJobs struct {
+	job *runpb.Job
+	err error
+}
+
+func (f *fakeJobs) GetJob(_ context.Context, req *runpb.GetJobRequest, _ ...gax.CallOption) (*runpb.Job, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if req.Name != f.job.Name {
+		return nil, fmt.Errorf("job %s not found", req.Name)
+	}
+	return f.job, nil
+}
+
+func TestRunnerContainer(t *testing.T) {
+	job := func(names ...string) *runpb.Job {
+		template := &runpb.TaskTemplate{}
+		for _, name := range names {
+			template.Containers = append(template.Containers, &runpb.Container{Name: name})
+		}
+		return &runpb.Job{Name: "projects/p/locations/r/jobs/runner", Template: &runpb.ExecutionTemplate{Template: template}}
+	}
+
+	tests := []struct {
+		name          string
+		jobs          *fakeJobs
+		containerName string
+		want          string
+		wantErr       string
+	}{
+		{name: "only container", jobs: &fakeJobs{job: job("runner")}, want: "runner"},
+		{name: "named container", jobs: &fakeJobs{job: job("runner", "docker")}, containerName: "runner", want: "runner"},
+		{name: "name needed with several containers", jobs: &fakeJobs{job: job("runner", "docker")}, wantErr: "has 2 containers, RUNNER_CONTAINER_NAME has to be set"},
+		{name: "missing container", jobs: &fakeJobs{job: job("runner")}, containerName: "dind", wantErr: "doesn't have container dind"},
+		{name: "job without containers", jobs: &fakeJobs{job: &runpb.Job{Name: "projects/p/locations/r/jobs/runner"}}, wantErr: "has 0 containers"},
+		{name: "job can't be read", jobs: &fakeJobs{err: errors.New("permission denied")}, wantErr: "could not get job projects/p/locations/r/jobs/runner: permission denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := runnerContainer(context.Background(), tt.jobs, "projects/p/locations/r/jobs/runner", tt.containerName)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %q and error %v, want %q", name, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || name != tt.want {
+				t.Errorf("got %q and error %v, want %q", name, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package gcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// runProfile overrides execution settings for jobs requesting the label
+type runProfile struct {
+	Label     string   `json:"label"`
+	TaskCount int32    `json:"taskCount,omitempty"`
+	Timeout   string   `json:"timeout,omitempty"`
+	Args      []string `json:"args,omitempty"`
+
+	timeout time.Duration
+}
+
+func parseRunProfiles(value string) ([]runProfile, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	var profiles []runProfile
+	if err := json.Unmarshal([]byte(value), &profiles); err != nil {
+		return nil, fmt.Errorf("invalid JOB_PROFILES: %w", err)
+	}
+	var errs []error
+	for i, profile := range profiles {
+		if len(profile.Label) == 0 {
+			errs = append(errs, fmt.Errorf("profile %+v doesn't have label", profile))
+		}
+		if profile.TaskCount < 0 {
+			errs = append(errs, fmt.Errorf("profile %s: task count can't be negative", profile.Label))
+		}
+		if len(profile.Timeout) > 0 {
+			timeout, err := time.ParseDuration(profile.Timeout)
+			if err != nil || timeout <= 0 {
+				errs = append(errs, fmt.Errorf("profile %s: invalid timeout %s", profile.Label, profile.Timeout))
+			}
+			profiles[i].timeout = timeout
+		}
+	}
+	return profiles, errors.Join(errs...)
+}
+
+// apply sets overrides of the profile to the request. Args are set to given container override.
+func (p *runProfile) apply(overrides *runpb.RunJobRequest_Overrides, containerOverride *runpb.RunJobRequest_Overrides_ContainerOverride) {
+	if p == nil {
+		return
+	}
+	overrides.TaskCount = p.TaskCount
+	if p.timeout > 0 {
+		overrides.Timeout = durationpb.New(p.timeout)
+	}
+	if len(p.Args) > 0 {
+		containerOverride.Args = p.Args
+	}
+}
@@ -0,0 +1,385 @@
+// Package fake provides in-process stand-in for GitHub Actions service, used to test message polling without network
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/actions/actions-runner-controller/github/actions"
+	"github.com/google/uuid"
+)
+
+const MessageQueueUrl = "https://fake.actions.githubusercontent.com/queue"
+
+// MessageStep is one scripted response to GetMessage
+type MessageStep struct {
+	Message *actions.RunnerScaleSetMessage
+	Err     error
+	// Delay before step is returned, e.g. to simulate long poll that ends without a message
+	Delay time.Duration
+	// Message queue access token expires before the step. GetMessage fails with expired token until session is refreshed,
+	// and returns the step after that.
+	ExpireToken bool
+}
+
+// ActionsService returns scripted messages in order. Once script is exhausted GetMessage blocks until context is done.
+// Other calls succeed by default, and can be overridden with the *Func fields. Calls using message queue access token fail
+// with actions.MessageQueueTokenExpiredError when token is not the latest one issued, or it has expired.
+type ActionsService struct {
+	// Used to create session, default succeeds
+	CreateMessageSessionFunc func(runnerScaleSetId int, owner string) (*actions.RunnerScaleSetSession, error)
+	// Used to acquire jobs, default acquires all of the requested jobs
+	AcquireJobsFunc func(requestIds []int64) ([]int64, error)
+	// Used to generate JIT configs, default registers runner with the requested name and returns config named after it
+	GenerateJitRunnerConfigFunc func(setting *actions.RunnerScaleSetJitRunnerSetting) (*actions.RunnerScaleSetJitRunnerConfig, error)
+
+	mu                 sync.Mutex
+	steps              []MessageStep
+	drained            chan struct{}
+	scaleSets          map[string]*actions.RunnerScaleSet
+	lastMessageIds     []int64
+	deletedMessageIds  []int64
+	acquireRequests    [][]int64
+	jitConfigs         []string
+	jitRunnerSettings  []actions.RunnerScaleSetJitRunnerSetting
+	deletedSessionIds  []uuid.UUID
+	deletedScaleSetIds []int
+	runners            map[string]*actions.RunnerReference
+	nextRunnerId       int
+	removedRunnerIds   []int64
+	token              string
+	issuedTokens       int
+	tokenExpired       bool
+	sessionRefreshes   int
+}
+
+func NewActionsService(steps ...MessageStep) *ActionsService {
+	return &ActionsService{
+		steps:     steps,
+		drained:   make(chan struct{}),
+		scaleSets: map[string]*actions.RunnerScaleSet{},
+		runners:   map[string]*actions.RunnerReference{},
+	}
+}
+
+// JobMessage builds RunnerScaleSetJobMessages message with given job messages, e.g. actions.JobAvailable, as body
+func JobMessage(messageId int64, jobMessages ...any) *actions.RunnerScaleSetMessage {
+	body, err := json.Marshal(jobMessages)
+	if err != nil {
+		panic(err)
+	}
+	return &actions.RunnerScaleSetMessage{
+		MessageId:   messageId,
+		MessageType: "RunnerScaleSetJobMessages",
+		Body:        string(body),
+	}
+}
+
+// JobAvailable builds JobAvailable job message for the request
+func JobAvailable(requestId int64, labels ...string) actions.JobAvailable {
+	return actions.JobAvailable{
+		JobMessageBase: jobMessageBase("JobAvailable", requestId, labels),
+	}
+}
+
+// JobAssigned builds JobAssigned job message for the request
+func JobAssigned(requestId int64, labels ...string) actions.JobAssigned {
+	return actions.JobAssigned{
+		JobMessageBase: jobMessageBase("JobAssigned", requestId, labels),
+	}
+}
+
+// JobCompleted builds JobCompleted job message for the request. Zero runnerId means that no runner picked the job up.
+func JobCompleted(requestId int64, result string, runnerId int) actions.JobCompleted {
+	return actions.JobCompleted{
+		Result:         result,
+		RunnerId:       runnerId,
+		JobMessageBase: jobMessageBase("JobCompleted", requestId, nil),
+	}
+}
+
+func jobMessageBase(messageType string, requestId int64, labels []string) actions.JobMessageBase {
+	return actions.JobMessageBase{
+		JobMessageType:  actions.JobMessageType{MessageType: messageType},
+		RunnerRequestId: requestId,
+		RequestLabels:   labels,
+	}
+}
+
+// Drained is closed when all scripted messages have been returned
+func (f *ActionsService) Drained() <-chan struct{} {
+	return f.drained
+}
+
+func (f *ActionsService) GetRunnerScaleSet(ctx context.Context, runnerGroupId int, runnerScaleSetName string) (*actions.RunnerScaleSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.scaleSets[runnerScaleSetName], nil
+}
+
+func (f *ActionsService) CreateRunnerScaleSet(ctx context.Context, runnerScaleSet *actions.RunnerScaleSet) (*actions.RunnerScaleSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	created := *runnerScaleSet
+	created.Id = len(f.scaleSets) + 1
+	f.scaleSets[created.Name] = &created
+	return &created, nil
+}
+
+func (f *ActionsService) DeleteRunnerScaleSet(ctx context.Context, runnerScaleSetId int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletedScaleSetIds = append(f.deletedScaleSetIds, runnerScaleSetId)
+	return nil
+}
+
+func (f *ActionsService) CreateMessageSession(ctx context.Context, runnerScaleSetId int, owner string) (*actions.RunnerScaleSetSession, error) {
+	if f.CreateMessageSessionFunc != nil {
+		session, err := f.CreateMessageSessionFunc(runnerScaleSetId, owner)
+		if session != nil {
+			f.mu.Lock()
+			f.token = session.MessageQueueAccessToken
+			f.mu.Unlock()
+		}
+		return session, err
+	}
+	sessionId := uuid.New()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.session(runnerScaleSetId, &sessionId, owner), nil
+}
+
+func (f *ActionsService) RefreshMessageSession(ctx context.Context, runnerScaleSetId int, sessionId *uuid.UUID) (*actions.RunnerScaleSetSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessionRefreshes++
+	return f.session(runnerScaleSetId, sessionId, ""), nil
+}
+
+// session issues new access token, which replaces the earlier one
+func (f *ActionsService) session(runnerScaleSetId int, sessionId *uuid.UUID, owner string) *actions.RunnerScaleSetSession {
+	f.issuedTokens++
+	f.token = fmt.Sprintf("fake-token-%d", f.issuedTokens)
+	f.tokenExpired = false
+	return &actions.RunnerScaleSetSession{
+		SessionId:               sessionId,
+		OwnerName:               owner,
+		RunnerScaleSet:          &actions.RunnerScaleSet{Id: runnerScaleSetId},
+		MessageQueueUrl:         MessageQueueUrl,
+		MessageQueueAccessToken: f.token,
+	}
+}
+
+// ExpireToken makes current message queue access token expired, e.g. from AcquireJobsFunc
+func (f *ActionsService) ExpireToken() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokenExpired = true
+}
+
+// checkToken has to be called with lock held
+func (f *ActionsService) checkToken(messageQueueAccessToken string) error {
+	if f.tokenExpired || messageQueueAccessToken != f.token {
+		return &actions.MessageQueueTokenExpiredError{}
+	}
+	return nil
+}
+
+func (f *ActionsService) DeleteMessageSession(ctx context.Context, runnerScaleSetId int, sessionId *uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if sessionId != nil {
+		f.deletedSessionIds = append(f.deletedSessionIds, *sessionId)
+	}
+	return nil
+}
+
+func (f *ActionsService) GetMessage(ctx context.Context, messageQueueUrl, messageQueueAccessToken string, lastMessageId int64) (*actions.RunnerScaleSetMessage, error) {
+	f.mu.Lock()
+	f.lastMessageIds = append(f.lastMessageIds, lastMessageId)
+	if len(f.steps) > 0 && f.steps[0].ExpireToken {
+		f.steps[0].ExpireToken = false
+		f.tokenExpired = true
+	}
+	if err := f.checkToken(messageQueueAccessToken); err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	if len(f.steps) == 0 {
+		select {
+		case <-f.drained:
+		default:
+			close(f.drained)
+		}
+		f.mu.Unlock()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	step := f.steps[0]
+	f.steps = f.steps[1:]
+	f.mu.Unlock()
+
+	if step.Delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(step.Delay):
+		}
+	}
+	return step.Message, step.Err
+}
+
+func (f *ActionsService) DeleteMessage(ctx context.Context, messageQueueUrl, messageQueueAccessToken string, messageId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkToken(messageQueueAccessToken); err != nil {
+		return err
+	}
+	f.deletedMessageIds = append(f.deletedMessageIds, messageId)
+	return nil
+}
+
+func (f *ActionsService) AcquireJobs(ctx context.Context, runnerScaleSetId int, messageQueueAccessToken string, requestIds []int64) ([]int64, error) {
+	f.mu.Lock()
+	if err := f.checkToken(messageQueueAccessToken); err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	f.acquireRequests = append(f.acquireRequests, slices.Clone(requestIds))
+	f.mu.Unlock()
+	if f.AcquireJobsFunc != nil {
+		return f.AcquireJobsFunc(requestIds)
+	}
+	return requestIds, nil
+}
+
+func (f *ActionsService) GenerateJitRunnerConfig(ctx context.Context, jitRunnerSetting *actions.RunnerScaleSetJitRunnerSetting, scaleSetId int) (*actions.RunnerScaleSetJitRunnerConfig, error) {
+	f.mu.Lock()
+	f.jitRunnerSettings = append(f.jitRunnerSettings, *jitRunnerSetting)
+	f.mu.Unlock()
+
+	if f.GenerateJitRunnerConfigFunc != nil {
+		jitConfig, err := f.GenerateJitRunnerConfigFunc(jitRunnerSetting)
+		if err == nil && jitConfig != nil {
+			f.mu.Lock()
+			f.jitConfigs = append(f.jitConfigs, jitConfig.EncodedJITConfig)
+			f.mu.Unlock()
+		}
+		return jitConfig, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Service refuses to register second runner with the same name
+	if _, exists := f.runners[jitRunnerSetting.Name]; exists {
+		return nil, &actions.ActionsError{
+			ExceptionName: "AgentExistsException",
+			Message:       fmt.Sprintf("runner %s already exists", jitRunnerSetting.Name),
+			StatusCode:    http.StatusConflict,
+		}
+	}
+	f.nextRunnerId++
+	runner := &actions.RunnerReference{Id: f.nextRunnerId, Name: jitRunnerSetting.Name, RunnerScaleSetId: scaleSetId}
+	f.runners[runner.Name] = runner
+	jitConfig := &actions.RunnerScaleSetJitRunnerConfig{
+		Runner:           runner,
+		EncodedJITConfig: "jit-" + runner.Name,
+	}
+	f.jitConfigs = append(f.jitConfigs, jitConfig.EncodedJITConfig)
+	return jitConfig, nil
+}
+
+// AddRunner registers runner to the scale set, e.g. to model runner started before autoscaler was restarted
+func (f *ActionsService) AddRunner(name string, scaleSetId int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextRunnerId++
+	f.runners[name] = &actions.RunnerReference{Id: f.nextRunnerId, Name: name, RunnerScaleSetId: scaleSetId}
+}
+
+func (f *ActionsService) GetRunnerByName(ctx context.Context, runnerName string) (*actions.RunnerReference, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.runners[runnerName], nil
+}
+
+func (f *ActionsService) RemoveRunner(ctx context.Context, runnerId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, runner := range f.runners {
+		if int64(runner.Id) == runnerId {
+			delete(f.runners, name)
+			f.removedRunnerIds = append(f.removedRunnerIds, runnerId)
+			return nil
+		}
+	}
+	return &actions.ActionsError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("runner %d not found", runnerId)}
+}
+
+// LastMessageIds returns lastMessageId of every GetMessage call in order
+func (f *ActionsService) LastMessageIds() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.lastMessageIds)
+}
+
+// DeletedMessageIds returns IDs of deleted messages in order
+func (f *ActionsService) DeletedMessageIds() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.deletedMessageIds)
+}
+
+// AcquireRequests returns requested IDs of every AcquireJobs call in order
+func (f *ActionsService) AcquireRequests() [][]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.acquireRequests)
+}
+
+// JitConfigs returns successfully generated JIT configs in order
+func (f *ActionsService) JitConfigs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.jitConfigs)
+}
+
+// JitRunnerSettings returns settings of every GenerateJitRunnerConfig call in order
+func (f *ActionsService) JitRunnerSettings() []actions.RunnerScaleSetJitRunnerSetting {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.jitRunnerSettings)
+}
+
+// DeletedSessionIds returns IDs of deleted message sessions
+func (f *ActionsService) DeletedSessionIds() []uuid.UUID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.deletedSessionIds)
+}
+
+// DeletedScaleSetIds returns IDs of deleted runner scale sets
+func (f *ActionsService) DeletedScaleSetIds() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.deletedScaleSetIds)
+}
+
+// RemovedRunnerIds returns IDs of removed runner registrations in order
+func (f *ActionsService) RemovedRunnerIds() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.removedRunnerIds)
+}
+
+// SessionRefreshes returns how many times message session was refreshed
+func (f *ActionsService) SessionRefreshes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sessionRefreshes
+}
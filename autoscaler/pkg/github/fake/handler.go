@@ -0,0 +1,94 @@
+package fake
+
+import (
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+)
+
+// TriggerHandler records runners it's asked to start instead of starting them
+type TriggerHandler struct {
+	// Runner count reported by CurrentRunnerCount
+	RunnerCount int
+	// Used to fail starting of runners, called with every runner before it's recorded
+	TriggerErrFunc func(runner github.RunnerRequest) error
+
+	mu        sync.Mutex
+	triggered [][]github.RunnerRequest
+	cancelled []int64
+}
+
+var _ github.TriggerHandler = &TriggerHandler{}
+var _ github.RunnerReaper = &TriggerHandler{}
+
+func (h *TriggerHandler) CurrentRunnerCount() (int, error) {
+	return h.RunnerCount, nil
+}
+
+func (h *TriggerHandler) TriggerNewRunners(runners []github.RunnerRequest) ([]int64, error) {
+	var batch []github.RunnerRequest
+	var started []int64
+	var errs []error
+	for _, runner := range runners {
+		if h.TriggerErrFunc != nil {
+			if err := h.TriggerErrFunc(runner); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		batch = append(batch, runner)
+		started = append(started, runner.RequestId)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(batch) > 0 {
+		h.triggered = append(h.triggered, batch)
+	}
+	return started, errors.Join(errs...)
+}
+
+func (h *TriggerHandler) NeededRunners(runners []github.RunnerRequest) error {
+	if count := len(runners) - h.RunnerCount; count > 0 {
+		_, err := h.TriggerNewRunners(runners[0:count])
+		return err
+	}
+	return nil
+}
+
+// StartReaper does nothing, cancellations are only recorded
+func (h *TriggerHandler) StartReaper() {}
+
+func (h *TriggerHandler) CancelRunnerRequest(requestId int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cancelled = append(h.cancelled, requestId)
+}
+
+// Triggered returns started runners of every triggered batch, in order
+func (h *TriggerHandler) Triggered() [][]github.RunnerRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.triggered)
+}
+
+// JitConfigs returns JIT configs of all triggered runners, in order
+func (h *TriggerHandler) JitConfigs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var jitConfigs []string
+	for _, runners := range h.triggered {
+		for _, runner := range runners {
+			jitConfigs = append(jitConfigs, runner.JitConfig)
+		}
+	}
+	return jitConfigs
+}
+
+// CancelledRequestIds returns requests passed to CancelRunnerRequest, in order
+func (h *TriggerHandler) CancelledRequestIds() []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.cancelled)
+}
@@ -0,0 +1,132 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/actions/actions-runner-controller/github/actions"
+)
+
+// Attempts to generate JIT config for a request before it's left to be retried with next delivery of the message
+const jitConfigAttempts = 3
+
+// runnerName is derived from the request, so that retried request reuses the name instead of leaving stale registrations behind
+func (asc *ActionsServiceClient) runnerName(requestId int64) string {
+	return fmt.Sprintf("%s-%d", asc.RunnerNamePrefix, requestId)
+}
+
+// generateJitConfigs returns runner for every request JIT config could be generated for, and errors of the rest
+func (asc *ActionsServiceClient) generateJitConfigs(runnerScaleSetId int, requestIds []int64, requestLabels map[int64][]string) ([]RunnerRequest, error) {
+	var runners []RunnerRequest
+	var errs []error
+	for _, requestId := range requestIds {
+		jitConfig, err := asc.generateJitConfig(runnerScaleSetId, requestId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("generating JIT config for request %d failed: %w", requestId, err))
+			continue
+		}
+		runners = append(runners, RunnerRequest{
+			RequestId: requestId,
+			Labels:    requestLabels[requestId],
+			JitConfig: jitConfig.EncodedJITConfig,
+		})
+	}
+	return runners, errors.Join(errs...)
+}
+
+func (asc *ActionsServiceClient) generateJitConfig(runnerScaleSetId int, requestId int64) (*actions.RunnerScaleSetJitRunnerConfig, error) {
+	setting := &actions.RunnerScaleSetJitRunnerSetting{
+		Name:       asc.runnerName(requestId),
+		WorkFolder: asc.RunnerWorkFolder,
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var jitConfig *actions.RunnerScaleSetJitRunnerConfig
+		jitConfig, err = asc.Client.GenerateJitRunnerConfig(asc.ctx, setting, runnerScaleSetId)
+		if err == nil && jitConfig != nil {
+			asc.unstartedRegistrations[requestId] = true
+			asc.logger.Debug(fmt.Sprintf("Generated JIT config for runner %s", setting.Name), slog.Int64("requestId", requestId))
+			return jitConfig, nil
+		}
+		if err == nil {
+			err = errors.New("service returned empty JIT config")
+		}
+		if runnerExists(err) && asc.unstartedRegistrations[requestId] {
+			// Earlier delivery registered the runner, but it never got started
+			if removeErr := asc.removeRunner(runnerScaleSetId, setting.Name); removeErr != nil {
+				err = errors.Join(err, removeErr)
+			}
+		} else if runnerExists(err) {
+			// Registration may belong to runner running the job, e.g. one started before autoscaler was restarted
+			return nil, fmt.Errorf("%w, keeping registration not made by this autoscaler", err)
+		}
+		if attempt == jitConfigAttempts {
+			return nil, err
+		}
+
+		asc.logger.Warn(fmt.Sprintf("Could not get JIT config for request %d, retrying (%d/%d)", requestId, attempt, jitConfigAttempts), slog.Any("err", err))
+		select {
+		case <-asc.ctx.Done():
+			return nil, asc.ctx.Err()
+		case <-time.After(time.Duration(attempt) * asc.JitConfigRetryDelay):
+		}
+	}
+}
+
+// removeRunner removes registration of the runner, if it belongs to the scale set
+func (asc *ActionsServiceClient) removeRunner(runnerScaleSetId int, name string) error {
+	runner, err := asc.Client.GetRunnerByName(asc.ctx, name)
+	if err != nil || runner == nil {
+		return err
+	}
+	if runner.RunnerScaleSetId != runnerScaleSetId {
+		return fmt.Errorf("runner %s belongs to another scale set %d", name, runner.RunnerScaleSetId)
+	}
+	asc.logger.Info(fmt.Sprintf("Removing existing registration of runner %s", name), slog.Int("runnerId", runner.Id))
+	return asc.Client.RemoveRunner(asc.ctx, int64(runner.Id))
+}
+
+func runnerExists(err error) bool {
+	var actionsError *actions.ActionsError
+	return errors.As(err, &actionsError) &&
+		actionsError.StatusCode == http.StatusConflict &&
+		strings.Contains(actionsError.ExceptionName, "AgentExistsException")
+}
+
+// acquiredRunners splits runners to ones service acquired the job for, and ones it refused. Registrations of refused runners are removed, as no job will ever use them.
+func (asc *ActionsServiceClient) acquiredRunners(runnerScaleSetId int, runners []RunnerRequest, acquiredIds []int64) (acquired []RunnerRequest, refused []RunnerRequest) {
+	for _, runner := range runners {
+		if slices.Contains(acquiredIds, runner.RequestId) {
+			acquired = append(acquired, runner)
+			continue
+		}
+		refused = append(refused, runner)
+		// Service doesn't tell why, but request can't be acquired when it's already assigned to other runner, cancelled or completed
+		asc.logger.Warn(fmt.Sprintf("Service refused to acquire request %d, not starting runner for it", runner.RequestId),
+			slog.Int64("requestId", runner.RequestId),
+			slog.String("reason", "request already assigned, cancelled or completed"),
+		)
+		if err := asc.removeRunner(runnerScaleSetId, asc.runnerName(runner.RequestId)); err != nil {
+			asc.logger.Warn(fmt.Sprintf("Could not remove registration of runner %s", asc.runnerName(runner.RequestId)), slog.Any("err", err))
+		}
+	}
+	for _, acquiredId := range acquiredIds {
+		if !slices.ContainsFunc(runners, func(runner RunnerRequest) bool { return runner.RequestId == acquiredId }) {
+			asc.logger.Warn(fmt.Sprintf("Service acquired request %d that wasn't requested", acquiredId))
+		}
+	}
+
+	metrics.Add(MetricJobsRequested, int64(len(runners)))
+	metrics.Add(MetricJobsAcquired, int64(len(acquired)))
+	metrics.Add(MetricJobsRefused, int64(len(refused)))
+	if len(refused) > 0 {
+		asc.logger.Info(fmt.Sprintf("Service acquired %d/%d of requested jobs", len(acquired), len(runners)))
+	}
+	return acquired, refused
+}
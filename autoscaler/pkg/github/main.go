@@ -17,8 +17,22 @@ import (
 
 type ActionsServiceClient struct {
 	ctx    context.Context
-	Client *actions.Client
+	Client ActionsService
 	logger *slog.Logger
+	// Runners are named <prefix>-<request ID>
+	RunnerNamePrefix string
+	// Work folder of the runners, service default is used when empty
+	RunnerWorkFolder string
+	// Delay between JIT config attempts, grows linearly with attempts
+	JitConfigRetryDelay time.Duration
+	// Deliveries of the message request is tried on before giving up, so that failing request doesn't block later messages
+	MaxRequestAttempts int
+
+	// Requests this client has registered runner for, but not started it. Only these registrations are replaced when
+	// runner with the same name already exists, as otherwise the runner may be running the job.
+	unstartedRegistrations map[int64]bool
+	// Failed attempts of the requests, kept over redeliveries of the message
+	requestAttempts map[int64]int
 }
 
 func CreateActionsServiceClient(ctx context.Context, pat string, githubConfigUrl string, logger *slog.Logger) *ActionsServiceClient {
@@ -31,10 +45,28 @@ func CreateActionsServiceClient(ctx context.Context, pat string, githubConfigUrl
 		log.Fatal(err.Error())
 	}
 
+	return NewActionsServiceClient(ctx, actionsServiceClient, logger)
+}
+
+// NewActionsServiceClient wraps given service, e.g. fake one in tests
+func NewActionsServiceClient(ctx context.Context, service ActionsService, logger *slog.Logger) *ActionsServiceClient {
 	return &ActionsServiceClient{
-		ctx:    ctx,
-		Client: actionsServiceClient,
-		logger: logger,
+		ctx:                 ctx,
+		Client:              service,
+		logger:              logger,
+		RunnerNamePrefix:    "gha-runner",
+		JitConfigRetryDelay: time.Second,
+		MaxRequestAttempts:  5,
+
+		unstartedRegistrations: map[int64]bool{},
+		requestAttempts:        map[int64]int{},
+	}
+}
+
+// Close releases idle connections of the underlying HTTP client
+func (asc *ActionsServiceClient) Close() {
+	if client, ok := asc.Client.(interface{ CloseIdleConnections() }); ok {
+		client.CloseIdleConnections()
 	}
 }
 
@@ -79,12 +111,22 @@ func (asc *ActionsServiceClient) StartMessagePolling(runnerScaleSetId int, handl
 
 	defer asc.Client.DeleteMessageSession(context.Background(), runnerScaleSetId, session.SessionId)
 
+	sessionClient := &SessionRefreshingClient{
+		client:           asc.Client,
+		logger:           asc.logger,
+		runnerScaleSetId: runnerScaleSetId,
+		session:          session,
+	}
+
 	var lastMessageId int64 = 0
 
 	var loopStartTime int64 = 0
 
 	var startedRequestIds []int64
 
+	// Requests runners have been started for, or service refused to give, so that redelivered message doesn't start them again
+	handledRequestIds := map[int64]bool{}
+
 	for {
 		loopStartTime = time.Now().Unix()
 		select {
@@ -93,8 +135,12 @@ func (asc *ActionsServiceClient) StartMessagePolling(runnerScaleSetId int, handl
 			return nil
 		default:
 			// Latest released version doesn't allow fetching more than one message at the time diretly. Building code for that as PoC.
-			message, _ := asc.Client.GetMessage(asc.ctx, session.MessageQueueUrl, session.MessageQueueAccessToken, lastMessageId)
+			message, _ := sessionClient.GetMessage(asc.ctx, lastMessageId)
 			if message == nil {
+				// Polling was interrupted by shutdown
+				if asc.ctx.Err() != nil {
+					continue
+				}
 				// Restart autoscaler if empty message is received too quicly. Long polling should keep polling open around a minute in normal case
 				if time.Now().Unix()-loopStartTime < 2 {
 					return fmt.Errorf("long polling doesn't work, restart needed")
@@ -119,6 +165,7 @@ func (asc *ActionsServiceClient) StartMessagePolling(runnerScaleSetId int, handl
 			}
 
 			var requestIds []int64
+			requestLabels := map[int64][]string{}
 			for _, rawMessage := range rawMessages {
 				var messageType actions.JobMessageType
 				if err := json.Unmarshal(rawMessage, &messageType); err != nil {
@@ -138,6 +185,7 @@ func (asc *ActionsServiceClient) StartMessagePolling(runnerScaleSetId int, handl
 						continue
 					}
 					requestIds = append(requestIds, jobAvailable.RunnerRequestId)
+					requestLabels[jobAvailable.RunnerRequestId] = jobAvailable.RequestLabels
 					startedRequestIds = append(startedRequestIds, jobAvailable.RunnerRequestId)
 				} else if messageType.MessageType == "JobAssigned" {
 					// Some reason service doesn't send every time job available message
@@ -150,11 +198,17 @@ func (asc *ActionsServiceClient) StartMessagePolling(runnerScaleSetId int, handl
 					}
 					if !slices.Contains(startedRequestIds, jobAssigned.RunnerRequestId) {
 						requestIds = append(requestIds, jobAssigned.RunnerRequestId)
+						requestLabels[jobAssigned.RunnerRequestId] = jobAssigned.RequestLabels
 					}
 				} else {
+					if messageType.MessageType == "JobCompleted" {
+						requestId := asc.cancelUnassignedRunner(rawMessage, handler)
+						delete(handledRequestIds, requestId)
+						delete(asc.unstartedRegistrations, requestId)
+					}
 					asc.logger.Debug(fmt.Sprintf("Not parsing message %s", messageType.MessageType))
 					lastMessageId = message.MessageId
-					asc.Client.DeleteMessage(asc.ctx, session.MessageQueueUrl, session.MessageQueueAccessToken, message.MessageId)
+					sessionClient.DeleteMessage(asc.ctx, message.MessageId)
 					continue
 				}
 			}
@@ -163,30 +217,108 @@ func (asc *ActionsServiceClient) StartMessagePolling(runnerScaleSetId int, handl
 				continue
 			}
 
-			var jitConfigs []string
-			for range len(requestIds) {
-				jitConfig, _ := asc.Client.GenerateJitRunnerConfig(asc.ctx, &actions.RunnerScaleSetJitRunnerSetting{}, runnerScaleSetId)
-				jitConfigs = append(jitConfigs, jitConfig.EncodedJITConfig)
-			}
-			if err != nil {
-				asc.logger.Warn("Could not get JIT config", slog.Any("err", err))
+			requestIds = slices.DeleteFunc(requestIds, func(requestId int64) bool { return handledRequestIds[requestId] })
+			if len(requestIds) == 0 {
+				asc.logger.Debug(fmt.Sprintf("Runners for requests of message %d already started, removing message", message.MessageId))
+				lastMessageId = message.MessageId
+				sessionClient.DeleteMessage(asc.ctx, lastMessageId)
 				continue
 			}
+			runners, jitErr := asc.generateJitConfigs(runnerScaleSetId, requestIds, requestLabels)
+			if jitErr != nil {
+				// Message is kept, so requests without runner are retried when it's delivered again
+				asc.logger.Warn("Could not get JIT config for all requests", slog.Any("err", jitErr))
+			}
 
-			jobs, err := asc.Client.AcquireJobs(asc.ctx, runnerScaleSetId, session.MessageQueueAccessToken, requestIds)
+			if len(runners) > 0 {
+				asc.startRunners(sessionClient, runnerScaleSetId, runners, handler, handledRequestIds)
+			}
 
-			if err == nil {
-				asc.logger.Info("Jobs acquired succesfully, acquiring runners")
-				err = handler.TriggerNewRunners(jitConfigs)
-				if err == nil {
-					lastMessageId = message.MessageId
-					asc.logger.Info(fmt.Sprintf("Acquired jobs %s, removing message...", strings.Join(strings.Fields(fmt.Sprint(jobs)), ", ")))
-					asc.Client.DeleteMessage(asc.ctx, session.MessageQueueUrl, session.MessageQueueAccessToken, lastMessageId)
-				}
+			if asc.giveUpFailedRequests(runnerScaleSetId, requestIds, handledRequestIds) {
+				lastMessageId = message.MessageId
+				asc.logger.Info(fmt.Sprintf("All requests of message %d handled, removing message...", message.MessageId))
+				sessionClient.DeleteMessage(asc.ctx, lastMessageId)
+			}
+		}
+	}
+}
 
-			} else {
-				slog.Error("Triggering new runners faileded", slog.Any("err", err))
+// startRunners acquires jobs of the runners, and starts runners for acquired ones. Requests service refused and ones
+// runner was started for are marked as handled.
+func (asc *ActionsServiceClient) startRunners(sessionClient *SessionRefreshingClient, runnerScaleSetId int, runners []RunnerRequest, handler TriggerHandler, handledRequestIds map[int64]bool) {
+	var acquireIds []int64
+	for _, runner := range runners {
+		acquireIds = append(acquireIds, runner.RequestId)
+	}
+	jobs, err := sessionClient.AcquireJobs(asc.ctx, acquireIds)
+	if err != nil {
+		asc.logger.Error("Acquiring jobs failed", slog.Any("err", err))
+		return
+	}
+
+	runners, refused := asc.acquiredRunners(runnerScaleSetId, runners, jobs)
+	for _, runner := range refused {
+		handledRequestIds[runner.RequestId] = true
+		delete(asc.unstartedRegistrations, runner.RequestId)
+	}
+	asc.logger.Info(fmt.Sprintf("Acquired jobs %s", strings.Join(strings.Fields(fmt.Sprint(jobs)), ", ")))
+	if len(runners) == 0 {
+		return
+	}
+	started, err := handler.TriggerNewRunners(runners)
+	// Started runners are never started again, nor their registrations removed, even if some others failed
+	metrics.Add(MetricRunnersTriggered, int64(len(started)))
+	for _, requestId := range started {
+		handledRequestIds[requestId] = true
+		delete(asc.unstartedRegistrations, requestId)
+	}
+	if err != nil {
+		asc.logger.Error(fmt.Sprintf("Started %d/%d runners, keeping message for retry", len(started), len(runners)), slog.Any("err", err))
+	}
+}
+
+// giveUpFailedRequests counts failed attempt for every request that isn't handled yet. Request that has failed on too many
+// deliveries is given up and registration of its runner removed, so that the message can be removed. Returns true when all
+// of the requests are handled.
+func (asc *ActionsServiceClient) giveUpFailedRequests(runnerScaleSetId int, requestIds []int64, handledRequestIds map[int64]bool) bool {
+	allHandled := true
+	for _, requestId := range requestIds {
+		if handledRequestIds[requestId] {
+			delete(asc.requestAttempts, requestId)
+			continue
+		}
+		asc.requestAttempts[requestId]++
+		if asc.requestAttempts[requestId] < asc.MaxRequestAttempts {
+			allHandled = false
+			continue
+		}
+		// Service has no call to release acquired job, so giving up is only logged and counted
+		asc.logger.Error(fmt.Sprintf("Giving up request %d after %d attempts", requestId, asc.requestAttempts[requestId]), slog.Int64("requestId", requestId))
+		metrics.Add(MetricRequestsAbandoned, 1)
+		handledRequestIds[requestId] = true
+		delete(asc.requestAttempts, requestId)
+		if asc.unstartedRegistrations[requestId] {
+			if err := asc.removeRunner(runnerScaleSetId, asc.runnerName(requestId)); err != nil {
+				asc.logger.Warn(fmt.Sprintf("Could not remove registration of runner %s", asc.runnerName(requestId)), slog.Any("err", err))
 			}
+			delete(asc.unstartedRegistrations, requestId)
 		}
 	}
+	return allHandled
+}
+
+// cancelUnassignedRunner lets handler stop the runner started for request that got cancelled before any runner picked it up.
+// Returns ID of the completed request.
+func (asc *ActionsServiceClient) cancelUnassignedRunner(rawMessage json.RawMessage, handler TriggerHandler) int64 {
+	var jobCompleted actions.JobCompleted
+	if err := json.Unmarshal(rawMessage, &jobCompleted); err != nil {
+		asc.logger.Warn("Failed to unmarshal message to job completed", slog.Any("err", err))
+		return 0
+	}
+	reaper, ok := handler.(RunnerReaper)
+	if ok && jobCompleted.Result == "canceled" && jobCompleted.RunnerId == 0 {
+		asc.logger.Info(fmt.Sprintf("Request %d was cancelled before runner picked it up", jobCompleted.RunnerRequestId))
+		reaper.CancelRunnerRequest(jobCompleted.RunnerRequestId)
+	}
+	return jobCompleted.RunnerRequestId
 }
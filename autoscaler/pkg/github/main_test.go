@@ -0,0 +1,509 @@
+package github_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/actions/actions-runner-controller/github/actions"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github/fake"
+)
+
+const scaleSetId = 1
+
+type scenario struct {
+	name  string
+	steps []fake.MessageStep
+	// Optional setup of fakes, e.g. to inject failures
+	setup func(service *fake.ActionsService, handler *fake.TriggerHandler)
+	// Optional settings of the client
+	configure func(client *github.ActionsServiceClient)
+
+	wantErr               bool
+	wantRunners           [][]github.RunnerRequest
+	wantDeletedMessageIds []int64
+	wantLastMessageIds    []int64
+	wantAcquireRequests   [][]int64
+	wantCancelled         []int64
+	wantRemovedRunnerIds  []int64
+	wantSessionRefreshes  int
+	// Checked only when set
+	wantRunnerSettings []actions.RunnerScaleSetJitRunnerSetting
+	// Change of the metrics during the scenario, checked only when set
+	wantMetrics map[string]int64
+}
+
+func TestStartMessagePolling(t *testing.T) {
+	scenarios := []scenario{
+		{
+			name: "job available starts runner",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101, "linux"))},
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, Labels: []string{"linux"}, JitConfig: "jit-gha-runner-101"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 1},
+			wantAcquireRequests:   [][]int64{{101}},
+		},
+		{
+			name: "all available jobs of message are started in one batch",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102))},
+				{Message: fake.JobMessage(2, fake.JobAvailable(103))},
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}, {RequestId: 102, JitConfig: "jit-gha-runner-102"}},
+				{{RequestId: 103, JitConfig: "jit-gha-runner-103"}},
+			},
+			wantDeletedMessageIds: []int64{1, 2},
+			wantLastMessageIds:    []int64{0, 1, 2},
+			wantAcquireRequests:   [][]int64{{101, 102}, {103}},
+		},
+		{
+			name: "job assigned without job available starts runner",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAssigned(101, "linux"))},
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, Labels: []string{"linux"}, JitConfig: "jit-gha-runner-101"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 1},
+			wantAcquireRequests:   [][]int64{{101}},
+		},
+		{
+			name: "job assigned after job available doesn't start another runner",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+				{Message: fake.JobMessage(2, fake.JobAssigned(101))},
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 1, 1},
+			wantAcquireRequests:   [][]int64{{101}},
+		},
+		{
+			name: "job completed is removed without starting runners",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobCompleted(101, "succeeded", 7))},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 1},
+		},
+		{
+			name: "job cancelled before runner picked it up cancels runner request",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+				{Message: fake.JobMessage(2, fake.JobCompleted(101, "canceled", 0))},
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+			},
+			wantDeletedMessageIds: []int64{1, 2},
+			wantLastMessageIds:    []int64{0, 1, 2},
+			wantAcquireRequests:   [][]int64{{101}},
+			wantCancelled:         []int64{101},
+		},
+		{
+			name: "other message types are skipped without removal",
+			steps: []fake.MessageStep{
+				{Message: &actions.RunnerScaleSetMessage{MessageId: 1, MessageType: "RunnerScaleSetStatistics"}},
+			},
+			wantLastMessageIds: []int64{0, 1},
+		},
+		{
+			name: "invalid message body is skipped without removal",
+			steps: []fake.MessageStep{
+				{Message: &actions.RunnerScaleSetMessage{MessageId: 1, MessageType: "RunnerScaleSetJobMessages", Body: "{"}},
+			},
+			wantLastMessageIds: []int64{0, 1},
+		},
+		{
+			name: "failed acquire keeps message for retry",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				service.AcquireJobsFunc = func(requestIds []int64) ([]int64, error) {
+					return nil, errors.New("acquire failed")
+				}
+			},
+			wantLastMessageIds:  []int64{0, 0},
+			wantAcquireRequests: [][]int64{{101}},
+		},
+		{
+			name: "failed trigger keeps message for retry",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				failed := false
+				handler.TriggerErrFunc = func(runner github.RunnerRequest) error {
+					if failed {
+						return nil
+					}
+					failed = true
+					return errors.New("trigger failed")
+				}
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 0, 1},
+			wantAcquireRequests:   [][]int64{{101}, {101}},
+			// Registration of the runner that was never started is replaced
+			wantRemovedRunnerIds: []int64{1},
+		},
+		{
+			name: "runners started before another failed are not started again",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102))},
+				{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				failed := false
+				handler.TriggerErrFunc = func(runner github.RunnerRequest) error {
+					if runner.RequestId != 102 || failed {
+						return nil
+					}
+					failed = true
+					return errors.New("trigger failed")
+				}
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+				{{RequestId: 102, JitConfig: "jit-gha-runner-102"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 0, 1},
+			wantAcquireRequests:   [][]int64{{101, 102}, {102}},
+			// Only registration of the runner that failed to start is replaced, running one is kept
+			wantRemovedRunnerIds: []int64{2},
+			wantMetrics: map[string]int64{
+				github.MetricRunnersTriggered: 2,
+			},
+		},
+		{
+			name: "request failing on every delivery is given up and later messages are handled",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102))},
+				{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102))},
+				{Message: fake.JobMessage(2, fake.JobAvailable(103))},
+			},
+			configure: func(client *github.ActionsServiceClient) {
+				client.MaxRequestAttempts = 2
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				handler.TriggerErrFunc = func(runner github.RunnerRequest) error {
+					if runner.RequestId == 102 {
+						return errors.New("quota exceeded")
+					}
+					return nil
+				}
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+				{{RequestId: 103, JitConfig: "jit-gha-runner-103"}},
+			},
+			wantDeletedMessageIds: []int64{1, 2},
+			wantLastMessageIds:    []int64{0, 0, 1, 2},
+			wantAcquireRequests:   [][]int64{{101, 102}, {102}, {103}},
+			// Registration of the first failed start is replaced, and the one of the last is removed when request is given up
+			wantRemovedRunnerIds: []int64{2, 3},
+			wantMetrics: map[string]int64{
+				github.MetricRunnersTriggered:  2,
+				github.MetricRequestsAbandoned: 1,
+			},
+		},
+		{
+			name: "request without JIT config on every delivery is given up",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			configure: func(client *github.ActionsServiceClient) {
+				client.MaxRequestAttempts = 2
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				service.GenerateJitRunnerConfigFunc = failingJitConfigs(map[string]int{"gha-runner-101": 100})
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 0, 1},
+			wantMetrics: map[string]int64{
+				github.MetricRequestsAbandoned: 1,
+			},
+		},
+		{
+			name: "registration not made by this autoscaler is kept",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				// Runner started before restart of the autoscaler may be running the job
+				service.AddRunner("gha-runner-101", scaleSetId)
+			},
+			wantLastMessageIds: []int64{0, 0},
+		},
+		{
+			name: "failed JIT config is retried",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				service.GenerateJitRunnerConfigFunc = failingJitConfigs(map[string]int{"gha-runner-101": 2})
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 1},
+			wantAcquireRequests:   [][]int64{{101}},
+		},
+		{
+			name: "request without JIT config is not acquired and message is kept",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102))},
+				{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				service.GenerateJitRunnerConfigFunc = failingJitConfigs(map[string]int{"gha-runner-102": 3})
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+				{{RequestId: 102, JitConfig: "jit-gha-runner-102"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 0, 1},
+			wantAcquireRequests:   [][]int64{{101}, {102}},
+		},
+		{
+			name: "runners are started only for acquired jobs",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102), fake.JobAvailable(103))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				service.AcquireJobsFunc = func(requestIds []int64) ([]int64, error) {
+					return []int64{101, 103}, nil
+				}
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}, {RequestId: 103, JitConfig: "jit-gha-runner-103"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 1},
+			wantAcquireRequests:   [][]int64{{101, 102, 103}},
+			wantRemovedRunnerIds:  []int64{2},
+			wantMetrics: map[string]int64{
+				github.MetricJobsRequested:    3,
+				github.MetricJobsAcquired:     2,
+				github.MetricJobsRefused:      1,
+				github.MetricRunnersTriggered: 2,
+			},
+		},
+		{
+			name: "no runners are started when no job is acquired",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				service.AcquireJobsFunc = func(requestIds []int64) ([]int64, error) {
+					return nil, nil
+				}
+			},
+			wantDeletedMessageIds: []int64{1, 1},
+			wantLastMessageIds:    []int64{0, 1, 1},
+			// Redelivered message doesn't try to acquire refused job again
+			wantAcquireRequests:  [][]int64{{101}},
+			wantRemovedRunnerIds: []int64{1},
+			wantMetrics: map[string]int64{
+				github.MetricJobsRefused:      1,
+				github.MetricRunnersTriggered: 0,
+			},
+		},
+		{
+			name: "runner name and work folder are configurable",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			configure: func(client *github.ActionsServiceClient) {
+				client.RunnerNamePrefix = "ci"
+				client.RunnerWorkFolder = "_ci"
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-ci-101"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 1},
+			wantAcquireRequests:   [][]int64{{101}},
+			wantRunnerSettings: []actions.RunnerScaleSetJitRunnerSetting{
+				{Name: "ci-101", WorkFolder: "_ci"},
+			},
+		},
+		{
+			name: "long poll ending without message keeps polling",
+			steps: []fake.MessageStep{
+				// Shorter polls are taken as broken long polling
+				{Delay: 2100 * time.Millisecond},
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 0, 1},
+			wantAcquireRequests:   [][]int64{{101}},
+		},
+		{
+			name: "token expired during long poll is refreshed and polling continues",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101)), ExpireToken: true},
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+			},
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 0, 1},
+			wantAcquireRequests:   [][]int64{{101}},
+			wantSessionRefreshes:  1,
+		},
+		{
+			name: "token expired on acquire is refreshed and acquire retried",
+			steps: []fake.MessageStep{
+				{Message: fake.JobMessage(1, fake.JobAvailable(101))},
+			},
+			setup: func(service *fake.ActionsService, handler *fake.TriggerHandler) {
+				expired := false
+				service.AcquireJobsFunc = func(requestIds []int64) ([]int64, error) {
+					if !expired {
+						expired = true
+						service.ExpireToken()
+						return nil, &actions.MessageQueueTokenExpiredError{}
+					}
+					return requestIds, nil
+				}
+			},
+			wantRunners: [][]github.RunnerRequest{
+				{{RequestId: 101, JitConfig: "jit-gha-runner-101"}},
+			},
+			// Message is removed with the refreshed token
+			wantDeletedMessageIds: []int64{1},
+			wantLastMessageIds:    []int64{0, 1},
+			wantAcquireRequests:   [][]int64{{101}, {101}},
+			wantSessionRefreshes:  1,
+		},
+		{
+			name: "empty poll returning immediately requires restart",
+			steps: []fake.MessageStep{
+				{Err: errors.New("connection refused")},
+			},
+			wantErr:            true,
+			wantLastMessageIds: []int64{0},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			service := fake.NewActionsService(s.steps...)
+			handler := &fake.TriggerHandler{}
+			if s.setup != nil {
+				s.setup(service, handler)
+			}
+
+			metricsBefore := map[string]int64{}
+			for name := range s.wantMetrics {
+				metricsBefore[name] = github.Metric(name)
+			}
+
+			err := runPolling(t, service, handler, s.configure)
+
+			if (err != nil) != s.wantErr {
+				t.Fatalf("StartMessagePolling() error = %v, wantErr %v", err, s.wantErr)
+			}
+			assertEqual(t, "triggered runners", handler.Triggered(), s.wantRunners)
+			assertEqual(t, "deleted messages", service.DeletedMessageIds(), s.wantDeletedMessageIds)
+			assertEqual(t, "lastMessageId of polls", service.LastMessageIds(), s.wantLastMessageIds)
+			assertEqual(t, "acquired jobs", service.AcquireRequests(), s.wantAcquireRequests)
+			assertEqual(t, "cancelled requests", handler.CancelledRequestIds(), s.wantCancelled)
+			assertEqual(t, "removed runners", service.RemovedRunnerIds(), s.wantRemovedRunnerIds)
+			if got := service.SessionRefreshes(); got != s.wantSessionRefreshes {
+				t.Errorf("session refreshes = %d, want %d", got, s.wantSessionRefreshes)
+			}
+			if s.wantRunnerSettings != nil {
+				assertEqual(t, "runner settings", service.JitRunnerSettings(), s.wantRunnerSettings)
+			}
+			for name, want := range s.wantMetrics {
+				if got := github.Metric(name) - metricsBefore[name]; got != want {
+					t.Errorf("metric %s changed by %d, want %d", name, got, want)
+				}
+			}
+			if len(service.DeletedSessionIds()) != 1 {
+				t.Errorf("message session was not removed")
+			}
+		})
+	}
+}
+
+// runPolling polls until scripted messages are handled, or polling returns
+func runPolling(t *testing.T, service *fake.ActionsService, handler github.TriggerHandler, configure func(client *github.ActionsServiceClient)) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := github.NewActionsServiceClient(ctx, service, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	client.JitConfigRetryDelay = time.Millisecond
+	if configure != nil {
+		configure(client)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.StartMessagePolling(scaleSetId, handler)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-service.Drained():
+		cancel()
+	}
+	err := <-done
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Fatal("polling didn't finish in time")
+	}
+	return err
+}
+
+// failingJitConfigs fails given number of JIT config requests for the runner names
+func failingJitConfigs(failures map[string]int) func(setting *actions.RunnerScaleSetJitRunnerSetting) (*actions.RunnerScaleSetJitRunnerConfig, error) {
+	return func(setting *actions.RunnerScaleSetJitRunnerSetting) (*actions.RunnerScaleSetJitRunnerConfig, error) {
+		if failures[setting.Name] > 0 {
+			failures[setting.Name]--
+			return nil, errors.New("service unavailable")
+		}
+		return &actions.RunnerScaleSetJitRunnerConfig{
+			Runner:           &actions.RunnerReference{Name: setting.Name},
+			EncodedJITConfig: "jit-" + setting.Name,
+		}, nil
+	}
+}
+
+func assertEqual[T any](t *testing.T, what string, got, want []T) {
+	t.Helper()
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %+v, want %+v", what, got, want)
+	}
+}
@@ -0,0 +1,38 @@
+package github
+
+import (
+	"expvar"
+)
+
+// Counters are published with expvar at /debug/vars of the health check server
+var metrics = expvar.NewMap("autoscaler")
+
+const (
+	// Jobs autoscaler tried to acquire
+	MetricJobsRequested = "jobsRequested"
+	// Jobs service let autoscaler acquire
+	MetricJobsAcquired = "jobsAcquired"
+	// Jobs service didn't let autoscaler acquire, so no runner was started for them
+	MetricJobsRefused = "jobsRefused"
+	// Runners handler was asked to start
+	MetricRunnersTriggered = "runnersTriggered"
+	// Requests given up after failing on every delivery of the message
+	MetricRequestsAbandoned = "requestsAbandoned"
+	// Executions handler saw starting, i.e. ACA and Cloud Run executions
+	MetricExecutionsStarted = "executionsStarted"
+	// Executions accepted by the platform, but not started before start timeout
+	MetricExecutionsNotYetStarted = "executionsNotYetStarted"
+)
+
+// AddMetric increases the counter, lets runner handlers publish their counters next to the ones of the autoscaler
+func AddMetric(name string, delta int64) {
+	metrics.Add(name, delta)
+}
+
+// Metric returns current value of the counter
+func Metric(name string) int64 {
+	if value, ok := metrics.Get(name).(*expvar.Int); ok {
+		return value.Value()
+	}
+	return 0
+}
@@ -1,12 +1,57 @@
 package github
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
 	"github.com/actions/actions-runner-controller/github/actions"
-	"github.com/go-logr/logr"
 )
 
+// SessionRefreshingClient makes message queue calls with access token of the session. Token is valid only for a while,
+// so session is refreshed and call retried once when service tells that token has expired.
 type SessionRefreshingClient struct {
-	client  actions.ActionsService
-	logger  logr.Logger
-	session *actions.RunnerScaleSetSession
+	client           ActionsService
+	logger           *slog.Logger
+	runnerScaleSetId int
+	session          *actions.RunnerScaleSetSession
+}
+
+func (c *SessionRefreshingClient) GetMessage(ctx context.Context, lastMessageId int64) (message *actions.RunnerScaleSetMessage, err error) {
+	err = c.withRefresh(ctx, func() error {
+		message, err = c.client.GetMessage(ctx, c.session.MessageQueueUrl, c.session.MessageQueueAccessToken, lastMessageId)
+		return err
+	})
+	return message, err
+}
+
+func (c *SessionRefreshingClient) DeleteMessage(ctx context.Context, messageId int64) error {
+	return c.withRefresh(ctx, func() error {
+		return c.client.DeleteMessage(ctx, c.session.MessageQueueUrl, c.session.MessageQueueAccessToken, messageId)
+	})
+}
+
+func (c *SessionRefreshingClient) AcquireJobs(ctx context.Context, requestIds []int64) (acquired []int64, err error) {
+	err = c.withRefresh(ctx, func() error {
+		acquired, err = c.client.AcquireJobs(ctx, c.runnerScaleSetId, c.session.MessageQueueAccessToken, requestIds)
+		return err
+	})
+	return acquired, err
+}
+
+func (c *SessionRefreshingClient) withRefresh(ctx context.Context, call func() error) error {
+	err := call()
+	var expiredErr *actions.MessageQueueTokenExpiredError
+	if !errors.As(err, &expiredErr) {
+		return err
+	}
+
+	c.logger.Info("Message queue token expired, refreshing session")
+	session, refreshErr := c.client.RefreshMessageSession(ctx, c.runnerScaleSetId, c.session.SessionId)
+	if refreshErr != nil {
+		return errors.Join(err, fmt.Errorf("refreshing message session failed: %w", refreshErr))
+	}
+	c.session = session
+	return call()
 }
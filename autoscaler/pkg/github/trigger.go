@@ -1,7 +1,25 @@
 package github
 
+// RunnerRequest links JIT config of the runner to the runner request it was generated for
+type RunnerRequest struct {
+	RequestId int64
+	// Labels requested by the job
+	Labels    []string
+	JitConfig string
+}
+
 type TriggerHandler interface {
 	CurrentRunnerCount() (int, error)
-	TriggerNewRunners(jitConfigs []string) error
-	NeededRunners(jitConfigs []string) error
+	// TriggerNewRunners starts runners and returns requests runners were started for. Started requests are returned also when
+	// starting some of the runners failed, so that they are not started again.
+	TriggerNewRunners(runners []RunnerRequest) (started []int64, err error)
+	NeededRunners(runners []RunnerRequest) error
+}
+
+// RunnerReaper is implemented by handlers that can clean up runners which are not needed anymore
+type RunnerReaper interface {
+	// StartReaper blocks and periodically stops runners that have outlived their purpose
+	StartReaper()
+	// CancelRunnerRequest marks runner started for the request to be stopped
+	CancelRunnerRequest(requestId int64)
 }
@@ -0,0 +1,266 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/reaper"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "gha-runner-autoscaler"
+	requestIdLabel = "actions.github.com/runner-request-id"
+	jitConfigKey   = "jitConfig"
+)
+
+type K8s struct {
+	ctx                 context.Context
+	logger              *slog.Logger
+	client              kubernetes.Interface
+	namespace           string
+	podTemplate         corev1.PodTemplateSpec
+	runnerContainerName string
+}
+
+func GetClient(ctx context.Context, logger *slog.Logger) (*K8s, error) {
+	namespace, err := requireEnv("KUBERNETES_NAMESPACE")
+	if err != nil {
+		return nil, err
+	}
+
+	podTemplate, err := loadPodTemplate(os.Getenv("POD_TEMPLATE_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(ctx, logger, client, namespace, podTemplate, getenv("RUNNER_CONTAINER_NAME", "runner"))
+}
+
+// NewClient creates handler using given clientset, e.g. fake one in tests
+func NewClient(ctx context.Context, logger *slog.Logger, client kubernetes.Interface, namespace string, podTemplate corev1.PodTemplateSpec, runnerContainerName string) (*K8s, error) {
+	if !slices.ContainsFunc(podTemplate.Spec.Containers, func(container corev1.Container) bool { return container.Name == runnerContainerName }) {
+		return nil, fmt.Errorf("pod template doesn't have container %s", runnerContainerName)
+	}
+
+	return &K8s{
+		ctx:                 ctx,
+		logger:              logger,
+		client:              client,
+		namespace:           namespace,
+		podTemplate:         podTemplate,
+		runnerContainerName: runnerContainerName,
+	}, nil
+}
+
+func (k *K8s) CurrentRunnerCount() (int, error) {
+	jobs, err := k.client.BatchV1().Jobs(k.namespace).List(k.ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", managedByLabel, managedBy),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, job := range jobs.Items {
+		if job.Status.Succeeded == 0 && job.Status.Failed == 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (k *K8s) TriggerNewRunners(runners []github.RunnerRequest) (started []int64, err error) {
+	var errs []error
+
+	for _, runner := range runners {
+		if err := k.createRunnerJob(runner); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		started = append(started, runner.RequestId)
+	}
+
+	return started, errors.Join(errs...)
+}
+
+// createRunnerJob creates job and secret holding the JIT config for it. Secret is owned by the job, so it's removed with the
+// job. Pod of the job waits for the secret, so secret can be created after the job.
+func (k *K8s) createRunnerJob(runner github.RunnerRequest) error {
+	labels := map[string]string{
+		managedByLabel: managedBy,
+		requestIdLabel: strconv.FormatInt(runner.RequestId, 10),
+	}
+	// Name is known before creation, as job refers to the secret by it
+	name := fmt.Sprintf("gha-runner-%d-%s", runner.RequestId, rand.String(5))
+
+	job, err := k.client.BatchV1().Jobs(k.namespace).Create(k.ctx, k.runnerJob(runner, name, labels), metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("creating job for request %d failed: %w", runner.RequestId, err)
+	}
+
+	_, err = k.client.CoreV1().Secrets(k.namespace).Create(k.ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(job, batchv1.SchemeGroupVersion.WithKind("Job")),
+			},
+		},
+		StringData: map[string]string{
+			jitConfigKey: runner.JitConfig,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		// Runner can't start without the secret, so job is removed and request is left to be retried
+		propagation := metav1.DeletePropagationBackground
+		if deleteErr := k.client.BatchV1().Jobs(k.namespace).Delete(k.ctx, job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation}); deleteErr != nil {
+			k.logger.Error(fmt.Sprintf("Could not remove job %s", job.Name), slog.Any("err", deleteErr))
+		}
+		return fmt.Errorf("creating secret for request %d failed: %w", runner.RequestId, err)
+	}
+
+	k.logger.Info(fmt.Sprintf("Created job %s for request %d", job.Name, runner.RequestId),
+		slog.Int64("requestId", runner.RequestId),
+		slog.String("job", job.Name),
+	)
+	return nil
+}
+
+// runnerJob builds job named after the request. Secret holding the JIT config has the same name.
+func (k *K8s) runnerJob(runner github.RunnerRequest, name string, labels map[string]string) *batchv1.Job {
+	podTemplate := *k.podTemplate.DeepCopy()
+	if podTemplate.Labels == nil {
+		podTemplate.Labels = map[string]string{}
+	}
+	for key, value := range labels {
+		podTemplate.Labels[key] = value
+	}
+	podTemplate.Spec.RestartPolicy = corev1.RestartPolicyNever
+
+	for i := range podTemplate.Spec.Containers {
+		container := &podTemplate.Spec.Containers[i]
+		if container.Name != k.runnerContainerName {
+			continue
+		}
+		container.Env = append(container.Env,
+			corev1.EnvVar{
+				Name: "ACTIONS_RUNNER_INPUT_JITCONFIG",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: name},
+						Key:                  jitConfigKey,
+					},
+				},
+			},
+			corev1.EnvVar{
+				Name:  reaper.RequestIdEnv,
+				Value: strconv.FormatInt(runner.RequestId, 10),
+			},
+		)
+	}
+
+	// Runners are ephemeral, so failed runner must not be retried with the same JIT config
+	backoffLimit := int32(0)
+	ttlSecondsAfterFinished := int32(300)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttlSecondsAfterFinished,
+			Template:                podTemplate,
+		},
+	}
+}
+
+func (k *K8s) NeededRunners(runners []github.RunnerRequest) (err error) {
+	currentRunners, err := k.CurrentRunnerCount()
+	if err != nil {
+		return err
+	}
+
+	count := len(runners)
+	k.logger.Debug(fmt.Sprintf("%d/%d of runners available", currentRunners, count))
+	if count-currentRunners > 0 {
+		k.logger.Debug(fmt.Sprintf("Triggering %d runners", count-currentRunners))
+		_, err = k.TriggerNewRunners(runners[0 : count-currentRunners])
+		return err
+	}
+
+	return nil
+}
+
+// loadPodTemplate reads pod template from YAML or JSON file. Without file, plain runner image is used.
+func loadPodTemplate(path string) (corev1.PodTemplateSpec, error) {
+	var podTemplate corev1.PodTemplateSpec
+	if len(path) == 0 {
+		podTemplate.Spec.Containers = []corev1.Container{
+			{
+				Name:    "runner",
+				Image:   "ghcr.io/actions/actions-runner:latest",
+				Command: []string{"/home/runner/run.sh"},
+			},
+		}
+		return podTemplate, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return podTemplate, err
+	}
+	if err := yaml.UnmarshalStrict(content, &podTemplate); err != nil {
+		return podTemplate, fmt.Errorf("invalid pod template %s: %w", path, err)
+	}
+	return podTemplate, nil
+}
+
+// clientConfig uses in-cluster configuration, or KUBECONFIG when running outside of the cluster
+func clientConfig() (*rest.Config, error) {
+	if kubeconfig := os.Getenv("KUBECONFIG"); len(kubeconfig) > 0 {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
+
+func requireEnv(key string) (value string, err error) {
+	value = os.Getenv(key)
+	if len(value) == 0 {
+		err = fmt.Errorf("value required for environment variable %s", key)
+	}
+	return
+}
+
+func getenv(key, fallback string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,158 @@
+package kubernetes_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/kubernetes"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/reaper"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const namespace = "runners"
+
+var podTemplate = corev1.PodTemplateSpec{
+	Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "runner", Image: "runner", Env: []corev1.EnvVar{{Name: "RUNNER_FOO", Value: "bar"}}},
+			{Name: "dind", Image: "docker:dind", Env: []corev1.EnvVar{{Name: "DOCKER_TLS_CERTDIR", Value: ""}}},
+		},
+	},
+}
+
+func newClient(t *testing.T, clientset *fake.Clientset) *kubernetes.K8s {
+	t.Helper()
+	client, err := kubernetes.NewClient(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), clientset, namespace, podTemplate, "runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestNewClientRequiresRunnerContainer(t *testing.T) {
+	_, err := kubernetes.NewClient(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), fake.NewClientset(), namespace, podTemplate, "missing")
+	if err == nil {
+		t.Error("NewClient() accepted pod template without runner container")
+	}
+}
+
+func TestTriggerNewRunners(t *testing.T) {
+	clientset := fake.NewClientset()
+	client := newClient(t, clientset)
+
+	started, err := client.TriggerNewRunners([]github.RunnerRequest{
+		{RequestId: 101, JitConfig: "jit-101"},
+		{RequestId: 102, JitConfig: "jit-102"},
+	})
+	if err != nil {
+		t.Fatalf("TriggerNewRunners() error = %v", err)
+	}
+	if len(started) != 2 || started[0] != 101 || started[1] != 102 {
+		t.Errorf("started = %v, want [101 102]", started)
+	}
+
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs.Items))
+	}
+	jitConfigs := map[string]string{"101": "jit-101", "102": "jit-102"}
+	for _, job := range jobs.Items {
+		requestId := job.Labels["actions.github.com/runner-request-id"]
+		if _, found := jitConfigs[requestId]; !found {
+			t.Fatalf("job %s has unexpected request ID label %q", job.Name, requestId)
+		}
+		if *job.Spec.BackoffLimit != 0 || job.Spec.Template.Spec.RestartPolicy != corev1.RestartPolicyNever {
+			t.Errorf("job %s would retry runner with used JIT config", job.Name)
+		}
+
+		containers := job.Spec.Template.Spec.Containers
+		runnerEnv := containers[0].Env
+		if len(runnerEnv) != 3 || runnerEnv[0].Name != "RUNNER_FOO" {
+			t.Fatalf("runner container env = %+v, want original env with JIT config and request ID", runnerEnv)
+		}
+		secretRef := runnerEnv[1].ValueFrom.SecretKeyRef
+		if runnerEnv[1].Name != "ACTIONS_RUNNER_INPUT_JITCONFIG" || secretRef == nil {
+			t.Fatalf("JIT config is not read from secret: %+v", runnerEnv[1])
+		}
+		if runnerEnv[2].Name != reaper.RequestIdEnv || runnerEnv[2].Value != requestId {
+			t.Errorf("request ID env = %+v, want %s", runnerEnv[2], requestId)
+		}
+		if len(containers[1].Env) != 1 || containers[1].Env[0].Name != "DOCKER_TLS_CERTDIR" {
+			t.Errorf("env of other container changed: %+v", containers[1].Env)
+		}
+
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(context.Background(), secretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("secret of job %s: %v", job.Name, err)
+		}
+		if secret.StringData[secretRef.Key] != jitConfigs[requestId] {
+			t.Errorf("secret %s holds %q, want %q", secret.Name, secret.StringData[secretRef.Key], jitConfigs[requestId])
+		}
+		owner := metav1.GetControllerOf(secret)
+		if owner == nil || owner.Kind != "Job" || owner.Name != job.Name {
+			t.Errorf("secret %s is owned by %+v, want job %s", secret.Name, owner, job.Name)
+		}
+	}
+	if podTemplate.Spec.Containers[0].Env[0].Name != "RUNNER_FOO" || len(podTemplate.Spec.Containers[0].Env) != 1 {
+		t.Errorf("pod template was modified")
+	}
+}
+
+func TestFailedSecretRemovesJob(t *testing.T) {
+	clientset := fake.NewClientset()
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("exceeded quota")
+	})
+	client := newClient(t, clientset)
+
+	started, err := client.TriggerNewRunners([]github.RunnerRequest{{RequestId: 101, JitConfig: "jit-101"}})
+	if err == nil || len(started) != 0 {
+		t.Fatalf("TriggerNewRunners() = %v, %v, want failure", started, err)
+	}
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Errorf("job without secret was left: %s", jobs.Items[0].Name)
+	}
+}
+
+func TestCurrentRunnerCount(t *testing.T) {
+	managed := map[string]string{"app.kubernetes.io/managed-by": "gha-runner-autoscaler"}
+	clientset := fake.NewClientset(
+		runnerJob("running", managed, batchv1.JobStatus{Active: 1}),
+		runnerJob("pending", managed, batchv1.JobStatus{}),
+		runnerJob("succeeded", managed, batchv1.JobStatus{Succeeded: 1}),
+		runnerJob("failed", managed, batchv1.JobStatus{Failed: 1}),
+		runnerJob("other", map[string]string{"app": "other"}, batchv1.JobStatus{Active: 1}),
+	)
+	client := newClient(t, clientset)
+
+	count, err := client.CurrentRunnerCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("CurrentRunnerCount() = %d, want 2", count)
+	}
+}
+
+func runnerJob(name string, labels map[string]string, status batchv1.JobStatus) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+		Status:     status,
+	}
+}
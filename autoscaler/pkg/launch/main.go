@@ -0,0 +1,71 @@
+// Package launch contains parts shared by handlers that start runners as executions of a platform job, e.g. ACA and Cloud Run
+package launch
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Settings struct {
+	// Maximum number of launches awaited at the same time
+	Concurrency int
+	// Time execution has to start in before it's considered launched, but not yet started. Such execution is not failed
+	// launch, as that would get another runner started for the request.
+	Timeout time.Duration
+}
+
+func FromEnv() (Settings, error) {
+	concurrency, err := strconv.Atoi(getenv("START_CONCURRENCY", "5"))
+	if err != nil || concurrency < 1 {
+		return Settings{}, fmt.Errorf("START_CONCURRENCY has to be positive integer, got %s", os.Getenv("START_CONCURRENCY"))
+	}
+	timeout, err := time.ParseDuration(getenv("START_TIMEOUT", "2m"))
+	if err != nil {
+		return Settings{}, fmt.Errorf("invalid START_TIMEOUT: %w", err)
+	}
+	return Settings{
+		Concurrency: concurrency,
+		Timeout:     timeout,
+	}, nil
+}
+
+// Run calls launch for indexes 0..count-1, at most Concurrency at the time, and returns their errors by index.
+// Launching an execution can take tens of seconds, so doing them one by one would delay the whole batch.
+func (s Settings) Run(count int, launch func(i int) error) []error {
+	errs := make([]error, count)
+	semaphore := make(chan struct{}, s.Concurrency)
+	var wg sync.WaitGroup
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			errs[i] = launch(i)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// MatchingProfile returns first profile whose label the job requested, or nil if none matches
+func MatchingProfile[P any](profiles []P, labels []string, label func(P) string) *P {
+	for i := range profiles {
+		if slices.Contains(labels, label(profiles[i])) {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+func getenv(key, fallback string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,178 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/reaper"
+)
+
+// Time runner has to exit after SIGTERM before it's killed
+const stopGracePeriod = 30 * time.Second
+
+// Local runs runners as child processes of the autoscaler. Meant for development and testing.
+type Local struct {
+	ctx     context.Context
+	logger  *slog.Logger
+	command []string
+	dir     string
+
+	mu        sync.Mutex
+	processes map[int64]*process
+	wg        sync.WaitGroup
+}
+
+type process struct {
+	cmd       *exec.Cmd
+	requestId int64
+	started   time.Time
+}
+
+func GetClient(ctx context.Context, logger *slog.Logger) (*Local, error) {
+	dir, err := requireEnv("LOCAL_RUNNER_DIR")
+	if err != nil {
+		return nil, err
+	}
+
+	command := []string{filepath.Join(dir, "run.sh"), "--jitconfig"}
+	if customCommand := os.Getenv("LOCAL_RUNNER_COMMAND"); len(customCommand) > 0 {
+		command = strings.Fields(customCommand)
+		if len(command) == 0 {
+			return nil, fmt.Errorf("LOCAL_RUNNER_COMMAND doesn't contain command")
+		}
+	}
+
+	return NewClient(ctx, logger, dir, command), nil
+}
+
+// NewClient creates handler running command in dir for every runner. JIT config is appended as last argument.
+func NewClient(ctx context.Context, logger *slog.Logger, dir string, command []string) *Local {
+	return &Local{
+		ctx:       ctx,
+		logger:    logger,
+		command:   command,
+		dir:       dir,
+		processes: map[int64]*process{},
+	}
+}
+
+func (l *Local) CurrentRunnerCount() (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.processes), nil
+}
+
+func (l *Local) TriggerNewRunners(runners []github.RunnerRequest) (started []int64, err error) {
+	var errs []error
+
+	for _, runner := range runners {
+		if err := l.start(runner); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		started = append(started, runner.RequestId)
+	}
+
+	return started, errors.Join(errs...)
+}
+
+func (l *Local) start(runner github.RunnerRequest) error {
+	args := append(slices.Clone(l.command[1:]), runner.JitConfig)
+	cmd := exec.CommandContext(l.ctx, l.command[0], args...)
+	cmd.Dir = l.dir
+	cmd.Env = append(os.Environ(),
+		"ACTIONS_RUNNER_INPUT_JITCONFIG="+runner.JitConfig,
+		fmt.Sprintf("%s=%d", reaper.RequestIdEnv, runner.RequestId),
+	)
+	// Runner output goes to stderr to keep stdout for autoscaler's own logs
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = stopGracePeriod
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting runner for request %d failed: %w", runner.RequestId, err)
+	}
+
+	p := &process{
+		cmd:       cmd,
+		requestId: runner.RequestId,
+		started:   time.Now(),
+	}
+	l.mu.Lock()
+	l.processes[runner.RequestId] = p
+	l.mu.Unlock()
+	l.logger.Info(fmt.Sprintf("Started runner process %d for request %d", cmd.Process.Pid, runner.RequestId),
+		slog.Int64("requestId", runner.RequestId),
+		slog.Int("pid", cmd.Process.Pid),
+	)
+
+	l.wg.Add(1)
+	go l.supervise(p)
+	return nil
+}
+
+// supervise waits for the runner process to exit and removes it from the process table
+func (l *Local) supervise(p *process) {
+	defer l.wg.Done()
+	err := p.cmd.Wait()
+
+	l.mu.Lock()
+	delete(l.processes, p.requestId)
+	l.mu.Unlock()
+
+	attrs := []any{
+		slog.Int64("requestId", p.requestId),
+		slog.Int("pid", p.cmd.Process.Pid),
+		slog.Int("exitCode", p.cmd.ProcessState.ExitCode()),
+		slog.Duration("duration", time.Since(p.started)),
+	}
+	if err != nil {
+		l.logger.Warn(fmt.Sprintf("Runner process of request %d failed", p.requestId), append(attrs, slog.Any("err", err))...)
+	} else {
+		l.logger.Info(fmt.Sprintf("Runner process of request %d exited", p.requestId), attrs...)
+	}
+}
+
+// Wait blocks until all runner processes have exited. Processes are stopped when context of the handler is done.
+func (l *Local) Wait() {
+	l.wg.Wait()
+}
+
+func (l *Local) NeededRunners(runners []github.RunnerRequest) (err error) {
+	currentRunners, err := l.CurrentRunnerCount()
+	if err != nil {
+		return err
+	}
+
+	count := len(runners)
+	l.logger.Debug(fmt.Sprintf("%d/%d of runners available", currentRunners, count))
+	if count-currentRunners > 0 {
+		l.logger.Debug(fmt.Sprintf("Triggering %d runners", count-currentRunners))
+		_, err = l.TriggerNewRunners(runners[0 : count-currentRunners])
+		return err
+	}
+
+	return nil
+}
+
+func requireEnv(key string) (value string, err error) {
+	value = os.Getenv(key)
+	if len(value) == 0 {
+		err = fmt.Errorf("value required for environment variable %s", key)
+	}
+	return
+}
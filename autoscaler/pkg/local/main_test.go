@@ -0,0 +1,78 @@
+package local_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github/fake"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/local"
+)
+
+// Stands in for run.sh of the runner, writes what it got to file named after the request
+const stubRunner = `echo "$1 $ACTIONS_RUNNER_INPUT_JITCONFIG" > "request-$RUNNER_REQUEST_ID"`
+
+func TestGetClientRejectsEmptyCommand(t *testing.T) {
+	t.Setenv("LOCAL_RUNNER_DIR", t.TempDir())
+	t.Setenv("LOCAL_RUNNER_COMMAND", "  ")
+	if _, err := local.GetClient(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Error("GetClient() accepted empty LOCAL_RUNNER_COMMAND")
+	}
+}
+
+func TestMessagePollingStartsLocalRunners(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "run.sh"), []byte(stubRunner), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	handler := local.NewClient(ctx, logger, dir, []string{"/bin/sh", "run.sh"})
+	service := fake.NewActionsService(
+		fake.MessageStep{Message: fake.JobMessage(1, fake.JobAvailable(101), fake.JobAvailable(102))},
+	)
+	client := github.NewActionsServiceClient(ctx, service, logger)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.StartMessagePolling(1, handler)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("polling stopped: %v", err)
+	case <-service.Drained():
+	}
+	// Let runners exit by themselves before stopping
+	for count, _ := handler.CurrentRunnerCount(); count > 0 && ctx.Err() == nil; count, _ = handler.CurrentRunnerCount() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("StartMessagePolling() error = %v", err)
+	}
+	handler.Wait()
+
+	for _, want := range []struct{ requestId, output string }{
+		{"101", "jit-gha-runner-101 jit-gha-runner-101\n"},
+		{"102", "jit-gha-runner-102 jit-gha-runner-102\n"},
+	} {
+		output, err := os.ReadFile(filepath.Join(dir, "request-"+want.requestId))
+		if err != nil {
+			t.Errorf("runner of request %s didn't run: %v", want.requestId, err)
+			continue
+		}
+		if string(output) != want.output {
+			t.Errorf("runner of request %s got %q, want %q", want.requestId, output, want.output)
+		}
+	}
+	if got := service.DeletedMessageIds(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("deleted messages = %v, want [1]", got)
+	}
+}
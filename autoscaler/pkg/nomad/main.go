@@ -0,0 +1,218 @@
+package nomad
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+)
+
+const (
+	jitConfigModePayload = "payload"
+	jitConfigModeMeta    = "meta"
+	requestIdMetaKey     = "runner_request_id"
+)
+
+type Nomad struct {
+	ctx           context.Context
+	logger        *slog.Logger
+	client        *http.Client
+	address       string
+	token         string
+	namespace     string
+	jobId         string
+	jitConfigMode string
+	jitConfigKey  string
+}
+
+type dispatchRequest struct {
+	Payload []byte            `json:"Payload,omitempty"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+}
+
+type dispatchResponse struct {
+	DispatchedJobID string `json:"DispatchedJobID"`
+	EvalID          string `json:"EvalID"`
+}
+
+type jobListStub struct {
+	ID         string `json:"ID"`
+	ParentID   string `json:"ParentID"`
+	JobSummary struct {
+		Summary map[string]taskGroupSummary `json:"Summary"`
+	} `json:"JobSummary"`
+}
+
+type taskGroupSummary struct {
+	Queued   int `json:"Queued"`
+	Starting int `json:"Starting"`
+	Running  int `json:"Running"`
+}
+
+func GetClient(ctx context.Context, logger *slog.Logger) (*Nomad, error) {
+	address, err1 := requireEnv("NOMAD_ADDR")
+	jobId, err2 := requireEnv("NOMAD_JOB")
+	if errors.Join(err1, err2) != nil {
+		return nil, errors.Join(err1, err2)
+	}
+
+	jitConfigMode := getenv("NOMAD_JIT_CONFIG_MODE", jitConfigModePayload)
+	if jitConfigMode != jitConfigModePayload && jitConfigMode != jitConfigModeMeta {
+		return nil, fmt.Errorf("unknown NOMAD_JIT_CONFIG_MODE %s, expected %s or %s", jitConfigMode, jitConfigModePayload, jitConfigModeMeta)
+	}
+
+	nomad := NewClient(ctx, logger, &http.Client{Timeout: 30 * time.Second}, address, jobId)
+	nomad.token = os.Getenv("NOMAD_TOKEN")
+	nomad.namespace = os.Getenv("NOMAD_NAMESPACE")
+	nomad.jitConfigMode = jitConfigMode
+	nomad.jitConfigKey = getenv("NOMAD_JIT_CONFIG_META_KEY", "jit_config")
+	return nomad, nil
+}
+
+// NewClient creates handler dispatching given parameterized job from Nomad at address, e.g. test server
+func NewClient(ctx context.Context, logger *slog.Logger, client *http.Client, address string, jobId string) *Nomad {
+	return &Nomad{
+		ctx:           ctx,
+		logger:        logger,
+		client:        client,
+		address:       strings.TrimSuffix(address, "/"),
+		jobId:         jobId,
+		jitConfigMode: jitConfigModePayload,
+		jitConfigKey:  "jit_config",
+	}
+}
+
+// CurrentRunnerCount counts queued, starting and running allocations of the jobs dispatched from the parameterized job
+func (n *Nomad) CurrentRunnerCount() (int, error) {
+	query := url.Values{}
+	query.Set("filter", fmt.Sprintf("ParentID == %s", strconv.Quote(n.jobId)))
+	var jobs []jobListStub
+	if err := n.do(http.MethodGet, "/v1/jobs", query, nil, &jobs); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, job := range jobs {
+		for _, summary := range job.JobSummary.Summary {
+			count += summary.Queued + summary.Starting + summary.Running
+		}
+	}
+	return count, nil
+}
+
+func (n *Nomad) TriggerNewRunners(runners []github.RunnerRequest) (started []int64, err error) {
+	var errs []error
+
+	for _, runner := range runners {
+		request := dispatchRequest{
+			Meta: map[string]string{
+				requestIdMetaKey: strconv.FormatInt(runner.RequestId, 10),
+			},
+		}
+		if n.jitConfigMode == jitConfigModeMeta {
+			request.Meta[n.jitConfigKey] = runner.JitConfig
+		} else {
+			request.Payload = []byte(runner.JitConfig)
+		}
+
+		var response dispatchResponse
+		err := n.do(http.MethodPost, fmt.Sprintf("/v1/job/%s/dispatch", url.PathEscape(n.jobId)), nil, request, &response)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dispatching job for request %d failed: %w", runner.RequestId, err))
+			continue
+		}
+		started = append(started, runner.RequestId)
+		n.logger.Info(fmt.Sprintf("Dispatched job %s for request %d", response.DispatchedJobID, runner.RequestId),
+			slog.Int64("requestId", runner.RequestId),
+			slog.String("job", response.DispatchedJobID),
+		)
+	}
+
+	return started, errors.Join(errs...)
+}
+
+func (n *Nomad) NeededRunners(runners []github.RunnerRequest) (err error) {
+	currentRunners, err := n.CurrentRunnerCount()
+	if err != nil {
+		return err
+	}
+
+	count := len(runners)
+	n.logger.Debug(fmt.Sprintf("%d/%d of runners available", currentRunners, count))
+	if count-currentRunners > 0 {
+		n.logger.Debug(fmt.Sprintf("Triggering %d runners", count-currentRunners))
+		_, err = n.TriggerNewRunners(runners[0 : count-currentRunners])
+		return err
+	}
+
+	return nil
+}
+
+// do calls Nomad HTTP API and decodes JSON response to result
+func (n *Nomad) do(method string, path string, query url.Values, body any, result any) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if len(n.namespace) > 0 {
+		query.Set("namespace", n.namespace)
+	}
+
+	var requestBody io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(payload)
+	}
+
+	request, err := http.NewRequestWithContext(n.ctx, method, fmt.Sprintf("%s%s?%s", n.address, path, query.Encode()), requestBody)
+	if err != nil {
+		return err
+	}
+	if len(n.token) > 0 {
+		request.Header.Set("X-Nomad-Token", n.token)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("nomad responded %s to %s %s: %s", response.Status, method, path, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func requireEnv(key string) (value string, err error) {
+	value = os.Getenv(key)
+	if len(value) == 0 {
+		err = fmt.Errorf("value required for environment variable %s", key)
+	}
+	return
+}
+
+func getenv(key, fallback string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	return value
+}
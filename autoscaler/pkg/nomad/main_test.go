@@ -0,0 +1,185 @@
+package nomad_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/github"
+	"github.com/hi-fi/gha-runners-on-managed-env/autoscaler/pkg/nomad"
+)
+
+type dispatch struct {
+	Payload []byte            `json:"Payload"`
+	Meta    map[string]string `json:"Meta"`
+}
+
+type request struct {
+	method    string
+	path      string
+	namespace string
+	filter    string
+	token     string
+	dispatch  dispatch
+}
+
+// nomadServer stands in for Nomad HTTP API, recording requests it gets
+type nomadServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []request
+}
+
+func newNomadServer(t *testing.T) *nomadServer {
+	server := &nomadServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorded := request{
+			method:    r.Method,
+			path:      r.URL.Path,
+			namespace: r.URL.Query().Get("namespace"),
+			filter:    r.URL.Query().Get("filter"),
+			token:     r.Header.Get("X-Nomad-Token"),
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/job/runner/dispatch":
+			if err := json.NewDecoder(r.Body).Decode(&recorded.dispatch); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, `{"DispatchedJobID": "runner/dispatch-1", "EvalID": "eval-1"}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/jobs":
+			io.WriteString(w, `[
+				{"ID": "runner/dispatch-1", "ParentID": "runner", "JobSummary": {"Summary": {"runner": {"Queued": 1, "Starting": 0, "Running": 0, "Complete": 3}}}},
+				{"ID": "runner/dispatch-2", "ParentID": "runner", "JobSummary": {"Summary": {"runner": {"Queued": 0, "Starting": 1, "Running": 2}, "sidecar": {"Running": 1}}}}
+			]`)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+		server.mu.Lock()
+		server.requests = append(server.requests, recorded)
+		server.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *nomadServer) recorded() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func getClient(t *testing.T, server *nomadServer, env map[string]string) *nomad.Nomad {
+	t.Helper()
+	t.Setenv("NOMAD_ADDR", server.URL+"/")
+	t.Setenv("NOMAD_JOB", "runner")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	client, err := nomad.GetClient(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestDispatch(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want request
+	}{
+		{
+			name: "JIT config as payload",
+			want: request{
+				method: http.MethodPost,
+				path:   "/v1/job/runner/dispatch",
+				dispatch: dispatch{
+					Payload: []byte("jit-101"),
+					Meta:    map[string]string{"runner_request_id": "101"},
+				},
+			},
+		},
+		{
+			name: "JIT config as meta with namespace and token",
+			env: map[string]string{
+				"NOMAD_JIT_CONFIG_MODE":     "meta",
+				"NOMAD_JIT_CONFIG_META_KEY": "jit",
+				"NOMAD_NAMESPACE":           "ci",
+				"NOMAD_TOKEN":               "secret",
+			},
+			want: request{
+				method:    http.MethodPost,
+				path:      "/v1/job/runner/dispatch",
+				namespace: "ci",
+				token:     "secret",
+				dispatch: dispatch{
+					Meta: map[string]string{"runner_request_id": "101", "jit": "jit-101"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newNomadServer(t)
+			client := getClient(t, server, tt.env)
+
+			started, err := client.TriggerNewRunners([]github.RunnerRequest{{RequestId: 101, JitConfig: "jit-101"}})
+			if err != nil {
+				t.Fatalf("TriggerNewRunners() error = %v", err)
+			}
+			if !reflect.DeepEqual(started, []int64{101}) {
+				t.Errorf("started = %v, want [101]", started)
+			}
+			if got := server.recorded(); !reflect.DeepEqual(got, []request{tt.want}) {
+				t.Errorf("requests = %+v, want %+v", got, []request{tt.want})
+			}
+		})
+	}
+}
+
+func TestFailedDispatchIsNotStarted(t *testing.T) {
+	server := newNomadServer(t)
+	t.Setenv("NOMAD_ADDR", server.URL)
+	t.Setenv("NOMAD_JOB", "missing")
+	client, err := nomad.GetClient(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, err := client.TriggerNewRunners([]github.RunnerRequest{{RequestId: 101, JitConfig: "jit-101"}})
+	if err == nil || len(started) != 0 {
+		t.Errorf("TriggerNewRunners() = %v, %v, want failure", started, err)
+	}
+}
+
+func TestCurrentRunnerCount(t *testing.T) {
+	server := newNomadServer(t)
+	client := getClient(t, server, map[string]string{"NOMAD_NAMESPACE": "ci", "NOMAD_TOKEN": "secret"})
+
+	count, err := client.CurrentRunnerCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queued, starting and running allocations of all task groups
+	if count != 5 {
+		t.Errorf("CurrentRunnerCount() = %d, want 5", count)
+	}
+	want := []request{{
+		method:    http.MethodGet,
+		path:      "/v1/jobs",
+		namespace: "ci",
+		filter:    `ParentID == "runner"`,
+		token:     "secret",
+	}}
+	if got := server.recorded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %+v, want %+v", got, want)
+	}
+}
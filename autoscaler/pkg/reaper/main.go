@@ -0,0 +1,116 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RequestIdEnv is set to every runner started by the autoscaler so that executions can be linked back to runner requests
+const RequestIdEnv = "RUNNER_REQUEST_ID"
+
+// How long cancelled request is remembered if no execution is found for it
+const cancelRetention = time.Hour
+
+type Policy struct {
+	// Executions running longer than this are stopped. Zero disables lifetime check.
+	MaxLifetime time.Duration
+	Interval    time.Duration
+
+	mu        sync.Mutex
+	cancelled map[int64]time.Time
+}
+
+func FromEnv() (*Policy, error) {
+	maxLifetime, err := durationEnv("MAX_RUNNER_LIFETIME", 0)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := durationEnv("REAPER_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("REAPER_INTERVAL has to be positive, got %s", interval)
+	}
+
+	return &Policy{
+		MaxLifetime: maxLifetime,
+		Interval:    interval,
+		cancelled:   map[int64]time.Time{},
+	}, nil
+}
+
+func (p *Policy) Cancel(requestId int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancelled[requestId] = time.Now()
+}
+
+// Reason returns why execution started at startTime for the request should be stopped, or empty string if it should be kept
+func (p *Policy) Reason(requestId int64, startTime time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, found := p.cancelled[requestId]; found {
+		return "runner request was cancelled before runner picked it up"
+	}
+	if p.MaxLifetime > 0 && !startTime.IsZero() && time.Since(startTime) > p.MaxLifetime {
+		return fmt.Sprintf("execution has been running longer than %s", p.MaxLifetime)
+	}
+	return ""
+}
+
+func (p *Policy) Forget(requestId int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.cancelled, requestId)
+}
+
+// Run calls reap every interval until context is done
+func (p *Policy) Run(ctx context.Context, logger *slog.Logger, reap func() error) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := reap(); err != nil {
+				logger.Warn("Reaping of runners failed", slog.Any("err", err))
+			}
+			p.prune()
+		}
+	}
+}
+
+func (p *Policy) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for requestId, cancelTime := range p.cancelled {
+		if time.Since(cancelTime) > cancelRetention {
+			delete(p.cancelled, requestId)
+		}
+	}
+}
+
+// RequestId parses runner request ID from value of RequestIdEnv
+func RequestId(value string) (int64, bool) {
+	requestId, err := strconv.ParseInt(value, 10, 64)
+	return requestId, err == nil
+}
+
+func durationEnv(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration for environment variable %s: %w", key, err)
+	}
+	return duration, nil
+}
@@ -0,0 +1,109 @@
+package reaper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReason(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxLifetime time.Duration
+		cancelled   bool
+		startTime   time.Time
+		want        string
+	}{
+		{name: "running within lifetime", maxLifetime: time.Hour, startTime: time.Now().Add(-time.Minute)},
+		{name: "running longer than lifetime", maxLifetime: time.Hour, startTime: time.Now().Add(-2 * time.Hour), want: "execution has been running longer than 1h0m0s"},
+		{name: "lifetime not checked", startTime: time.Now().Add(-48 * time.Hour)},
+		{name: "not yet started", maxLifetime: time.Hour},
+		{name: "cancelled", cancelled: true, startTime: time.Now(), want: "runner request was cancelled before runner picked it up"},
+		{name: "cancelled before start", maxLifetime: time.Hour, cancelled: true, want: "runner request was cancelled before runner picked it up"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &Policy{MaxLifetime: tt.maxLifetime, cancelled: map[int64]time.Time{}}
+			if tt.cancelled {
+				policy.Cancel(1)
+			}
+			if reason := policy.Reason(1, tt.startTime); reason != tt.want {
+				t.Errorf("got reason %q, want %q", reason, tt.want)
+			}
+			if reason := policy.Reason(2, tt.startTime); tt.cancelled && reason != "" {
+				t.Errorf("request that wasn't cancelled got reason %q", reason)
+			}
+		})
+	}
+}
+
+func TestForget(t *testing.T) {
+	policy := &Policy{cancelled: map[int64]time.Time{}}
+	policy.Cancel(1)
+	policy.Forget(1)
+	if reason := policy.Reason(1, time.Now()); reason != "" {
+		t.Errorf("forgotten request got reason %q", reason)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name      string
+		cancelled time.Duration
+		wantKept  bool
+	}{
+		{name: "recently cancelled", cancelled: time.Minute, wantKept: true},
+		{name: "cancelled within retention", cancelled: cancelRetention - time.Minute, wantKept: true},
+		{name: "cancelled before retention", cancelled: cancelRetention + time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &Policy{cancelled: map[int64]time.Time{1: time.Now().Add(-tt.cancelled)}}
+			policy.prune()
+			if _, kept := policy.cancelled[1]; kept != tt.wantKept {
+				t.Errorf("got kept %t, want %t", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	tests := []struct {
+		value     string
+		want      int64
+		wantFound bool
+	}{
+		{value: "123", want: 123, wantFound: true},
+		{value: ""},
+		{value: "abc"},
+		{value: "12.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			requestId, found := RequestId(tt.value)
+			if requestId != tt.want || found != tt.wantFound {
+				t.Errorf("got %d and %t, want %d and %t", requestId, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("MAX_RUNNER_LIFETIME", "6h")
+	t.Setenv("REAPER_INTERVAL", "")
+	policy, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.MaxLifetime != 6*time.Hour || policy.Interval != time.Minute {
+		t.Errorf("got lifetime %s and interval %s, want 6h and default 1m", policy.MaxLifetime, policy.Interval)
+	}
+
+	for key, value := range map[string]string{"MAX_RUNNER_LIFETIME": "forever", "REAPER_INTERVAL": "0s"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := FromEnv(); err == nil {
+				t.Errorf("%s=%s was accepted", key, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+#!/bin/sh
+
+# Resolve JIT config that autoscaler stored as secret (JIT_CONFIG_STORE) before starting the runner
+if [ -n "$ACTIONS_RUNNER_INPUT_JITCONFIG_REF" ]; then
+  ACTIONS_RUNNER_INPUT_JITCONFIG="$(/home/runner/ecs/jitconfig)" || exit 1
+  export ACTIONS_RUNNER_INPUT_JITCONFIG
+fi
+
+exec /home/runner/run.sh "$@"
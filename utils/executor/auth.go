@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// newClient returns client retrying failed requests at most retryMax times
+func newClient(tlsConfig *tls.Config, auth *runnerAuth, retryMax int) (*http.Client, error) {
+	retryClient := retryablehttp.NewClient()
+	retryClient.RetryMax = retryMax
+	retryClient.RetryWaitMax = 30 * time.Second
+	retryClient.HTTPClient.Timeout = 5 * time.Minute // timeout must be > 1m to accomodate long polling
+
+	transport, ok := retryClient.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("unexpected transport of HTTP client")
+	}
+	transport.TLSClientConfig = tlsConfig
+	// Signed on every retry, so that timestamp of the signature is fresh
+	retryClient.HTTPClient.Transport = &signingTransport{next: transport, auth: auth}
+
+	return retryClient.StandardClient(), nil
+}
+
+// loadTLSConfig reads TLS settings of the runner host connection. Returns nil when TLS is not used.
+func loadTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("RUNNER_TLS_CA_FILE")
+	certFile := os.Getenv("RUNNER_TLS_CERT_FILE")
+	keyFile := os.Getenv("RUNNER_TLS_KEY_FILE")
+	if os.Getenv("RUNNER_TLS") != "true" && len(caFile) == 0 && len(certFile) == 0 {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: os.Getenv("RUNNER_TLS_SERVER_NAME"),
+	}
+	if len(caFile) > 0 {
+		caPem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found from %s", caFile)
+		}
+	}
+	// Client certificate for mTLS
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+const (
+	tokenHeader     = "x-runner-token"
+	timestampHeader = "x-runner-timestamp"
+	signatureHeader = "x-runner-signature"
+	nonceHeader     = "x-runner-nonce"
+	// Signed message older than this is refused, to prevent replaying old commands
+	maxSignatureAge = 5 * time.Minute
+)
+
+// runnerAuth authenticates executor to runner host, and commands from runner host to executor. Either shared token or HMAC key is used.
+//
+// With shared token, requests and poll responses carry the token in x-runner-token header.
+// With HMAC key, requests carry random x-runner-nonce header. Requests and poll responses carry x-runner-timestamp header
+// with unix time, and x-runner-signature header with "sha256=" and hex encoded HMAC-SHA256 of timestamp, nonce, method,
+// path with query and body, separated by newlines. Poll response is signed with nonce, method and path of the request it
+// responds to, so that recorded response can't be replayed as response to another poll.
+type runnerAuth struct {
+	token   string
+	hmacKey []byte
+}
+
+func loadRunnerAuth() (*runnerAuth, error) {
+	auth := &runnerAuth{
+		token:   os.Getenv("RUNNER_TOKEN"),
+		hmacKey: []byte(os.Getenv("RUNNER_HMAC_KEY")),
+	}
+	if len(auth.token) > 0 && len(auth.hmacKey) > 0 {
+		return nil, errors.New("only one of RUNNER_TOKEN and RUNNER_HMAC_KEY can be set")
+	}
+	if !auth.enabled() && os.Getenv("ALLOW_UNAUTHENTICATED") != "true" {
+		return nil, errors.New("RUNNER_TOKEN or RUNNER_HMAC_KEY is required, set ALLOW_UNAUTHENTICATED=true to run commands without authentication")
+	}
+	return auth, nil
+}
+
+func (a *runnerAuth) enabled() bool {
+	return len(a.token) > 0 || len(a.hmacKey) > 0
+}
+
+func (a *runnerAuth) signature(timestamp string, nonce string, method string, path string, body []byte) string {
+	mac := hmac.New(sha256.New, a.hmacKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", timestamp, nonce, method, path)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *runnerAuth) sign(request *http.Request, body []byte) error {
+	if len(a.token) > 0 {
+		request.Header.Set(tokenHeader, a.token)
+	}
+	if len(a.hmacKey) > 0 {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(timestampHeader, timestamp)
+		request.Header.Set(nonceHeader, hex.EncodeToString(nonce))
+		request.Header.Set(signatureHeader, a.signature(timestamp, request.Header.Get(nonceHeader), request.Method, request.URL.RequestURI(), body))
+	}
+	return nil
+}
+
+// verify checks that response to the request came from runner host knowing the shared secret
+func (a *runnerAuth) verify(response *http.Response, body []byte) error {
+	if len(a.token) > 0 && !hmac.Equal([]byte(response.Header.Get(tokenHeader)), []byte(a.token)) {
+		return errors.New("response doesn't have valid token")
+	}
+	if len(a.hmacKey) > 0 {
+		timestamp := response.Header.Get(timestampHeader)
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.New("response doesn't have valid timestamp")
+		}
+		if age := time.Since(time.Unix(unix, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+			return fmt.Errorf("response signature is too old or from the future (%s)", age)
+		}
+		nonce := response.Request.Header.Get(nonceHeader)
+		if len(nonce) == 0 {
+			return errors.New("request of the response has no nonce")
+		}
+		expected := a.signature(timestamp, nonce, response.Request.Method, response.Request.URL.RequestURI(), body)
+		if !hmac.Equal([]byte(response.Header.Get(signatureHeader)), []byte(expected)) {
+			return errors.New("response doesn't have valid signature")
+		}
+	}
+	return nil
+}
+
+// signingTransport adds authentication to every request sent to runner host
+type signingTransport struct {
+	next http.RoundTripper
+	auth *runnerAuth
+}
+
+func (t *signingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = io.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Request must not be modified, so headers are set to a copy
+	signed := request.Clone(request.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	if err := t.auth.sign(signed, body); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(signed)
+}
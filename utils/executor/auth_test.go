@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runnerHost stands in for runner host sharing the HMAC key. It refuses requests without valid signature, and signs its
+// responses with the given age.
+func runnerHost(t *testing.T, key string, age time.Duration, body string) *httptest.Server {
+	host := &runnerAuth{hmacKey: []byte(key)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(timestampHeader)
+		nonce := r.Header.Get(nonceHeader)
+		if len(nonce) == 0 || r.Header.Get(signatureHeader) != host.signature(timestamp, nonce, r.Method, r.URL.RequestURI(), requestBody) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		timestamp = strconv.FormatInt(time.Now().Add(-age).Unix(), 10)
+		w.Header().Set(timestampHeader, timestamp)
+		w.Header().Set(signatureHeader, host.signature(timestamp, nonce, r.Method, r.URL.RequestURI(), []byte(body)))
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// roundTrip sends signed request to the host and verifies its response
+func roundTrip(t *testing.T, auth *runnerAuth, address string) error {
+	t.Helper()
+	client, err := newClient(nil, auth, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Post(address+"/poll?job=1", "text/plain", strings.NewReader("request body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("runner host responded %s", response.Status)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth.verify(response, body)
+}
+
+func TestHMACRoundTrip(t *testing.T) {
+	server := runnerHost(t, "secret", 0, "echo hello")
+	if err := roundTrip(t, &runnerAuth{hmacKey: []byte("secret")}, server.URL); err != nil {
+		t.Errorf("valid response was refused: %v", err)
+	}
+}
+
+func TestHMACRefusesStaleResponse(t *testing.T) {
+	server := runnerHost(t, "secret", maxSignatureAge+time.Minute, "echo hello")
+	err := roundTrip(t, &runnerAuth{hmacKey: []byte("secret")}, server.URL)
+	if err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Errorf("got %v, want stale signature to be refused", err)
+	}
+}
+
+func TestHMACRefusesTamperedResponse(t *testing.T) {
+	auth := &runnerAuth{hmacKey: []byte("secret")}
+	request := httptest.NewRequest(http.MethodGet, "/poll", nil)
+	if err := auth.sign(request, nil); err != nil {
+		t.Fatal(err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	response := &http.Response{Header: http.Header{}, Request: request}
+	response.Header.Set(timestampHeader, timestamp)
+	response.Header.Set(signatureHeader, auth.signature(timestamp, request.Header.Get(nonceHeader), http.MethodGet, "/poll", []byte("echo hello")))
+
+	if err := auth.verify(response, []byte("echo hello")); err != nil {
+		t.Errorf("valid response was refused: %v", err)
+	}
+	if err := auth.verify(response, []byte("rm -rf /")); err == nil {
+		t.Error("response with changed body was accepted")
+	}
+	if err := (&runnerAuth{hmacKey: []byte("other")}).verify(response, []byte("echo hello")); err == nil {
+		t.Error("response signed with other key was accepted")
+	}
+}
+
+func TestHMACRefusesReplayedResponse(t *testing.T) {
+	auth := &runnerAuth{hmacKey: []byte("secret")}
+	first := httptest.NewRequest(http.MethodGet, "/poll", nil)
+	second := httptest.NewRequest(http.MethodGet, "/poll", nil)
+	auth.sign(first, nil)
+	auth.sign(second, nil)
+	if first.Header.Get(nonceHeader) == second.Header.Get(nonceHeader) {
+		t.Fatalf("requests got the same nonce %s", first.Header.Get(nonceHeader))
+	}
+
+	// Response to the first poll, recorded and sent again as response to the second one
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	response := &http.Response{Header: http.Header{}, Request: first}
+	response.Header.Set(timestampHeader, timestamp)
+	response.Header.Set(signatureHeader, auth.signature(timestamp, first.Header.Get(nonceHeader), http.MethodGet, "/poll", []byte("echo hello")))
+	if err := auth.verify(response, []byte("echo hello")); err != nil {
+		t.Fatalf("valid response was refused: %v", err)
+	}
+	response.Request = second
+	if err := auth.verify(response, []byte("echo hello")); err == nil {
+		t.Error("response to another request was accepted")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	auth := &runnerAuth{token: "token"}
+	request := httptest.NewRequest(http.MethodGet, "/poll", nil)
+	auth.sign(request, nil)
+	if request.Header.Get(tokenHeader) != "token" {
+		t.Errorf("request has token %q", request.Header.Get(tokenHeader))
+	}
+
+	response := &http.Response{Header: http.Header{}, Request: request}
+	if err := auth.verify(response, nil); err == nil {
+		t.Error("response without token was accepted")
+	}
+	response.Header.Set(tokenHeader, "token")
+	if err := auth.verify(response, nil); err != nil {
+		t.Errorf("response with token was refused: %v", err)
+	}
+}
+
+func TestPollingIsNotRetriedByClient(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "restarting", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	auth := &runnerAuth{token: "token"}
+	pollClient, err := newClient(nil, auth, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &executor{pollClient: pollClient, auth: auth, baseUrl: server.URL}
+
+	// Failure is left to backoff of the executor, so that it's seen in connection state right away
+	if _, err := e.get(context.Background(), "/poll"); err == nil {
+		t.Error("failed poll returned no error")
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Shell used for scripts when job doesn't specify one
+const defaultShell = "/bin/sh"
+
+// Time output is still read after killed command, in case some process outside of its group holds output open
+const outputWaitDelay = 5 * time.Second
+
+// JobSpec tells what to run and how. Mirrors what runner container hooks need for step execution, i.e. entry point with
+// arguments, environment, prepended PATH and working directory.
+type JobSpec struct {
+	// Identifies the job in logs, result and cancel requests. Generated by executor if not given.
+	Id string `json:"id,omitempty"`
+	// Program and its arguments. Either argv or script is required.
+	Argv []string `json:"argv,omitempty"`
+	// Script run with shell
+	Script string `json:"script,omitempty"`
+	Shell  string `json:"shell,omitempty"`
+	// Added to environment of the executor
+	Env map[string]string `json:"env,omitempty"`
+	// Directories added to start of PATH. Used also when looking up program of argv.
+	PrependPath      []string `json:"prependPath,omitempty"`
+	WorkingDirectory string   `json:"workingDirectory,omitempty"`
+	Stdin            string   `json:"stdin,omitempty"`
+	// Overrides COMMAND_TIMEOUT
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// parseJobSpec reads job from /poll response body
+func parseJobSpec(body []byte) (JobSpec, error) {
+	var spec JobSpec
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("{")) {
+		spec.Script = string(trimmed)
+		return spec, spec.validate()
+	}
+	if err := json.Unmarshal(trimmed, &spec); err != nil {
+		return spec, fmt.Errorf("invalid job spec: %w", err)
+	}
+	return spec, spec.validate()
+}
+
+func (spec JobSpec) validate() error {
+	var errs []error
+	if len(spec.Argv) == 0 && len(strings.TrimSpace(spec.Script)) == 0 {
+		errs = append(errs, errors.New("job spec needs argv or script"))
+	}
+	if len(spec.Argv) > 0 && len(spec.Script) > 0 {
+		errs = append(errs, errors.New("job spec can't have both argv and script"))
+	}
+	if spec.TimeoutSeconds < 0 {
+		errs = append(errs, errors.New("timeout can't be negative"))
+	}
+	for key := range spec.Env {
+		if len(key) == 0 || strings.ContainsAny(key, "=\x00") {
+			errs = append(errs, fmt.Errorf("invalid environment variable name %q", key))
+		}
+	}
+	if len(spec.WorkingDirectory) > 0 {
+		if info, err := os.Stat(spec.WorkingDirectory); err != nil {
+			errs = append(errs, fmt.Errorf("working directory: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("working directory %s is not a directory", spec.WorkingDirectory))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// String describes job in logs
+func (spec JobSpec) String() string {
+	if len(spec.Argv) > 0 {
+		return strings.Join(spec.Argv, " ")
+	}
+	return fmt.Sprintf("script (%d bytes)", len(spec.Script))
+}
+
+// command builds command for the job. When context is done, process group of the command gets SIGTERM, and SIGKILL after grace period.
+// Returned function cancels pending SIGKILL, and has to be called when command has been waited for, as process group ID
+// can be reused after that.
+func (spec JobSpec) command(ctx context.Context, gracePeriod time.Duration) (*exec.Cmd, func()) {
+	path := os.Getenv("PATH")
+	if len(spec.PrependPath) > 0 {
+		path = strings.Join(append(slices.Clone(spec.PrependPath), path), string(os.PathListSeparator))
+	}
+
+	var execution *exec.Cmd
+	if len(spec.Argv) > 0 {
+		execution = exec.CommandContext(ctx, lookPath(spec.Argv[0], spec.PrependPath), spec.Argv[1:]...)
+		// Keep original name visible to the program
+		execution.Args[0] = spec.Argv[0]
+	} else {
+		shell := spec.Shell
+		if len(shell) == 0 {
+			shell = defaultShell
+		}
+		execution = exec.CommandContext(ctx, shell, "-c", spec.Script)
+	}
+
+	execution.Dir = spec.WorkingDirectory
+	execution.Env = append(os.Environ(), "PATH="+path)
+	for key, value := range spec.Env {
+		execution.Env = append(execution.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+	if len(spec.Stdin) > 0 {
+		execution.Stdin = strings.NewReader(spec.Stdin)
+	}
+
+	// Signal whole process group, so that children of the shell don't keep running or hold output open
+	execution.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var mu sync.Mutex
+	var kill *time.Timer
+	execution.Cancel = func() error {
+		processGroup := -execution.Process.Pid
+		mu.Lock()
+		kill = time.AfterFunc(gracePeriod, func() {
+			syscall.Kill(processGroup, syscall.SIGKILL)
+		})
+		mu.Unlock()
+		return syscall.Kill(processGroup, syscall.SIGTERM)
+	}
+	execution.WaitDelay = gracePeriod + outputWaitDelay
+	return execution, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
+
+// lookPath looks program first from prepended directories, then from PATH of the executor
+func lookPath(name string, prependPath []string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	for _, dir := range prependPath {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return candidate
+		}
+	}
+	return name
+}
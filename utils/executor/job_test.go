@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseJobSpec(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o600)
+
+	tests := []struct {
+		name    string
+		body    string
+		want    JobSpec
+		wantErr string
+	}{
+		{name: "plain command line is run as script", body: "  echo hello\n", want: JobSpec{Script: "echo hello"}},
+		{name: "argv", body: `{"id": "job-1", "argv": ["echo", "hello"], "env": {"A": "1"}, "timeoutSeconds": 10}`, want: JobSpec{Id: "job-1", Argv: []string{"echo", "hello"}, Env: map[string]string{"A": "1"}, TimeoutSeconds: 10}},
+		{name: "script with shell", body: `{"script": "echo hello", "shell": "/bin/bash"}`, want: JobSpec{Script: "echo hello", Shell: "/bin/bash"}},
+		{name: "invalid JSON", body: `{"argv": `, wantErr: "invalid job spec"},
+		{name: "empty", body: " ", wantErr: "needs argv or script"},
+		{name: "nothing to run", body: `{"id": "job-1"}`, wantErr: "needs argv or script"},
+		{name: "both argv and script", body: `{"argv": ["true"], "script": "true"}`, wantErr: "both argv and script"},
+		{name: "negative timeout", body: `{"argv": ["true"], "timeoutSeconds": -1}`, wantErr: "timeout can't be negative"},
+		{name: "invalid environment variable", body: `{"argv": ["true"], "env": {"A=B": "1"}}`, wantErr: `invalid environment variable name "A=B"`},
+		{name: "missing working directory", body: `{"argv": ["true"], "workingDirectory": "/does/not/exist"}`, wantErr: "working directory"},
+		{name: "working directory is a file", body: `{"argv": ["true"], "workingDirectory": "` + file + `"}`, wantErr: "is not a directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseJobSpec([]byte(tt.body))
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if !reflect.DeepEqual(spec, tt.want) {
+				t.Errorf("got %+v, want %+v", spec, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	err := JobSpec{TimeoutSeconds: -1, Env: map[string]string{"": "1"}}.validate()
+	if err == nil {
+		t.Fatal("invalid spec was accepted")
+	}
+	for _, want := range []string{"needs argv or script", "timeout can't be negative", "invalid environment variable name"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't tell %q", err.Error(), want)
+		}
+	}
+}
+
+func TestCommandStopsProcessGroupOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// Child of the shell would keep output open if only the shell got the signal
+	execution, stopKill := JobSpec{Script: "trap 'exit 3' TERM; sleep 30 & wait"}.command(ctx, time.Minute)
+	execution.Stdout = &bytes.Buffer{}
+	if err := execution.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	execution.Wait()
+	stopKill()
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("command was stopped after %s, want it to stop on SIGTERM", elapsed)
+	}
+	if code := execution.ProcessState.ExitCode(); code != 3 {
+		t.Errorf("got exit code %d, want 3 from TERM trap", code)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Buffered output is sent at least this often
+	logFlushInterval = time.Second
+	// Output is sent right away when this much is buffered
+	logChunkSize = 64 * 1024
+)
+
+// logChunk is part of the output. Sequence runs over both streams, so that host can order chunks and ignore resent ones.
+type logChunk struct {
+	sequence int
+	stream   string
+	data     []byte
+}
+
+// logStreamer sends command output to the runner host while the command runs. Chunks that fail to send are kept and resent in order.
+type logStreamer struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	mu       sync.Mutex
+	buffered map[string]*bytes.Buffer
+	streams  []string
+	pending  []logChunk
+	sequence int
+
+	flush chan struct{}
+	close chan struct{}
+	done  chan struct{}
+}
+
+func newLogStreamer(ctx context.Context, client *http.Client, url string) *logStreamer {
+	l := &logStreamer{
+		ctx:      ctx,
+		client:   client,
+		url:      url,
+		buffered: map[string]*bytes.Buffer{},
+		flush:    make(chan struct{}, 1),
+		close:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Writer returns writer for the named output stream
+func (l *logStreamer) Writer(stream string) io.Writer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.buffered[stream]; !ok {
+		l.buffered[stream] = &bytes.Buffer{}
+		l.streams = append(l.streams, stream)
+	}
+	return &streamWriter{streamer: l, stream: stream}
+}
+
+type streamWriter struct {
+	streamer *logStreamer
+	stream   string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	l := w.streamer
+	l.mu.Lock()
+	buffer := l.buffered[w.stream]
+	buffer.Write(p)
+	full := buffer.Len() >= logChunkSize
+	l.mu.Unlock()
+
+	if full {
+		select {
+		case l.flush <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Close sends rest of the output, and returns when it's sent or context is done
+func (l *logStreamer) Close() {
+	close(l.close)
+	<-l.done
+}
+
+func (l *logStreamer) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		closing := false
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-l.flush:
+		case <-l.close:
+			closing = true
+		}
+
+		l.cut()
+		for !l.send() && closing {
+			// Keep retrying until everything is sent, as otherwise end of the output would be lost
+			select {
+			case <-l.ctx.Done():
+				return
+			case <-time.After(logFlushInterval):
+			}
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+// cut moves buffered output to pending chunks
+func (l *logStreamer) cut() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, stream := range l.streams {
+		buffer := l.buffered[stream]
+		if buffer.Len() == 0 {
+			continue
+		}
+		l.pending = append(l.pending, logChunk{
+			sequence: l.sequence,
+			stream:   stream,
+			data:     bytes.Clone(buffer.Bytes()),
+		})
+		l.sequence++
+		buffer.Reset()
+	}
+}
+
+// send sends pending chunks in order. Returns false if some chunk couldn't be sent.
+func (l *logStreamer) send() bool {
+	for {
+		l.mu.Lock()
+		if len(l.pending) == 0 {
+			l.mu.Unlock()
+			return true
+		}
+		chunk := l.pending[0]
+		l.mu.Unlock()
+
+		if err := l.post(chunk); err != nil {
+			fmt.Printf("Sending log chunk %d failed, retrying later. Error: %s\n", chunk.sequence, err.Error())
+			return false
+		}
+
+		l.mu.Lock()
+		l.pending = l.pending[1:]
+		l.mu.Unlock()
+	}
+}
+
+func (l *logStreamer) post(chunk logChunk) error {
+	address, err := url.Parse(l.url)
+	if err != nil {
+		return err
+	}
+	query := address.Query()
+	query.Set("stream", chunk.stream)
+	query.Set("sequence", strconv.Itoa(chunk.sequence))
+	address.RawQuery = query.Encode()
+	request, err := http.NewRequestWithContext(l.ctx, http.MethodPost, address.String(), bytes.NewReader(chunk.data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	response, err := l.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("runner host responded %s", response.Status)
+	}
+	return nil
+}
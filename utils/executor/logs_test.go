@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type receivedChunk struct {
+	sequence string
+	stream   string
+	data     string
+}
+
+func TestLogStreamerResendsFailedChunk(t *testing.T) {
+	var mu sync.Mutex
+	var received []receivedChunk
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, receivedChunk{r.URL.Query().Get("sequence"), r.URL.Query().Get("stream"), string(data)})
+		// First attempt of the first chunk fails
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	logs := newLogStreamer(context.Background(), server.Client(), server.URL+"/logs?job=1")
+	stdout := logs.Writer("stdout")
+	stderr := logs.Writer("stderr")
+	stdout.Write([]byte("out"))
+	stderr.Write([]byte("err"))
+	logs.Close()
+
+	want := []receivedChunk{
+		{"0", "stdout", "out"},
+		{"0", "stdout", "out"},
+		{"1", "stderr", "err"},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("got chunks %+v, want %+v", received, want)
+	}
+}
@@ -1,37 +1,74 @@
+// Executor polls runner host for commands, runs them and reports output and result back.
+//
+// GET /poll returns JobSpec as JSON. Body that isn't JSON object is run as shell command line, as in earlier versions.
+// Up to MAX_CONCURRENT_JOBS jobs are run at the same time, and job can be cancelled through GET /cancel, see pollCancels.
+// On SIGTERM all running jobs are cancelled and reported.
+//
+// Polling is retried with capped exponential backoff when runner host can't be reached. Executor exits only on SIGTERM, or when
+// runner host has been unreachable longer than MAX_OUTAGE if set. State of the connection is served at HEALTH_PORT.
+//
+// When command has ended, its result is sent with POST /done?job=<id> as JSON object described by CommandResult.
+//
+// Output is streamed while command runs with POST /logs?job=<id>&stream=<stdout|stderr>&sequence=<n>. Sequence numbers run over both
+// streams starting from 0 for every command. Chunk that failed to send is sent again with the same sequence number, so host
+// should ignore sequence numbers it has already seen.
+//
+// Runner host is authenticated with RUNNER_TOKEN or RUNNER_HMAC_KEY, see runnerAuth. Commands without valid authentication are
+// refused. Executor doesn't start without either of those, unless ALLOW_UNAUTHENTICATED is true. HTTPS is used when RUNNER_TLS is true or RUNNER_TLS_CA_FILE is set, and RUNNER_TLS_CERT_FILE with
+// RUNNER_TLS_KEY_FILE enables mTLS.
 package main
 
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
+)
 
-	"github.com/hashicorp/go-retryablehttp"
+// Errors telling why job was stopped before it ended by itself
+var (
+	errJobCancelled    = errors.New("job cancelled by runner host")
+	errExecutorStopped = errors.New("executor stopped")
+	errUnauthenticated = errors.New("unauthenticated response")
 )
 
-func newClient() (*http.Client, error) {
-	retryClient := retryablehttp.NewClient()
-	retryClient.RetryMax = 4
-	retryClient.RetryWaitMax = 30 * time.Second
-	retryClient.HTTPClient.Timeout = 5 * time.Minute // timeout must be > 1m to accomodate long polling
-	retryClient.StandardClient()
+// Time results of jobs cancelled at shutdown are still tried to be sent after their processes have been stopped
+const reportGracePeriod = 30 * time.Second
 
-	return retryClient.StandardClient(), nil
-}
+// executor runs jobs polled from runner host, possibly several at the time
+type executor struct {
+	client *http.Client
+	// Used for /poll and /cancel without retries, as failures of those are retried with backoff of the executor
+	pollClient *http.Client
+	auth       *runnerAuth
+	baseUrl    string
+	// Used for sending logs and results, outlives polling context so that results of cancelled jobs get sent
+	reportCtx         context.Context
+	commandTimeout    time.Duration
+	cancelGracePeriod time.Duration
+	// Executor gives up when runner host has been unreachable this long, zero means never
+	maxOutage  time.Duration
+	connection *connection
 
-type CommandResponse struct {
-	ReturnCode int    `json:"returnCode"`
-	ErrorLogs  string `json:"errorLogs"`
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc
+	wg      sync.WaitGroup
 }
 
-func waitForCommands(ctx context.Context, client *http.Client) {
+func waitForCommands(ctx context.Context, client *http.Client, pollClient *http.Client, auth *runnerAuth, useTLS bool) {
 	runnerHost, isSet := os.LookupEnv("RUNNER_HOST")
 	if !isSet {
 		fmt.Printf("RUNNER_HOST is mandatory for command execution")
@@ -43,50 +80,448 @@ func waitForCommands(ctx context.Context, client *http.Client) {
 		return
 	}
 
-	fmt.Printf("Starting to poll host %s:%s\n", runnerHost, runnerPort)
+	var commandTimeout time.Duration
+	if value, isSet := os.LookupEnv("COMMAND_TIMEOUT"); isSet {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("COMMAND_TIMEOUT %s is not valid duration", value)
+			return
+		}
+		commandTimeout = timeout
+	}
+
+	cancelGracePeriod := 10 * time.Second
+	if value, isSet := os.LookupEnv("CANCEL_GRACE_PERIOD"); isSet {
+		gracePeriod, err := time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("CANCEL_GRACE_PERIOD %s is not valid duration", value)
+			return
+		}
+		cancelGracePeriod = gracePeriod
+	}
+
+	var maxOutage time.Duration
+	if value, isSet := os.LookupEnv("MAX_OUTAGE"); isSet {
+		outage, err := time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("MAX_OUTAGE %s is not valid duration", value)
+			return
+		}
+		maxOutage = outage
+	}
+
+	maxBackoff := time.Minute
+	if value, isSet := os.LookupEnv("MAX_BACKOFF"); isSet {
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff <= 0 {
+			fmt.Printf("MAX_BACKOFF %s is not valid duration", value)
+			return
+		}
+		maxBackoff = backoff
+	}
+
+	maxJobs := 1
+	if value, isSet := os.LookupEnv("MAX_CONCURRENT_JOBS"); isSet {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			fmt.Printf("MAX_CONCURRENT_JOBS %s is not positive number", value)
+			return
+		}
+		maxJobs = count
+	}
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+
+	reportCtx, cancelReports := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelReports()
+	stopReports := context.AfterFunc(ctx, func() {
+		time.AfterFunc(cancelGracePeriod+outputWaitDelay+reportGracePeriod, cancelReports)
+	})
+	defer stopReports()
+
+	e := &executor{
+		client:            client,
+		pollClient:        pollClient,
+		auth:              auth,
+		baseUrl:           fmt.Sprintf("%s://%s:%s", scheme, runnerHost, runnerPort),
+		reportCtx:         reportCtx,
+		commandTimeout:    commandTimeout,
+		cancelGracePeriod: cancelGracePeriod,
+		maxOutage:         maxOutage,
+		connection:        &connection{maxBackoff: maxBackoff, changed: time.Now()},
+		running:           map[string]context.CancelCauseFunc{},
+	}
+	defer e.wg.Wait()
+
+	go e.startHealthCheck()
+
+	go e.pollCancels(ctx)
+
+	// Job is polled only when there's free slot to run it
+	slots := make(chan struct{}, maxJobs)
+	fmt.Printf("Starting to poll %s, running at most %d jobs at the time\n", e.baseUrl, maxJobs)
 	for {
 		select {
 		case <-ctx.Done():
+			fmt.Printf("Stopping, cancelling %d running jobs\n", e.runningCount())
 			return
-		default:
-			response, err := client.Get(fmt.Sprintf("http://%s:%s/poll", runnerHost, runnerPort))
-			if err != nil {
-				fmt.Printf("Error happened. Error: %s\n", err.Error())
-				return
+		case slots <- struct{}{}:
+		}
+
+		body, err := e.get(ctx, "/poll")
+		if err != nil {
+			<-slots
+			if ctx.Err() != nil {
+				continue
 			}
-			defer response.Body.Close()
-			if response.StatusCode == http.StatusOK {
-				bodyBytes, err := io.ReadAll(response.Body)
-				if err != nil {
-					fmt.Printf("Error happened. Error: %s\n", err.Error())
+			if errors.Is(err, errUnauthenticated) {
+				fmt.Printf("Refusing unauthenticated command from %s. Error: %s\n", e.baseUrl, err.Error())
+			} else {
+				fmt.Printf("Polling %s failed. Error: %s\n", e.baseUrl, err.Error())
+			}
+			wait, outage := e.connection.failed()
+			if e.maxOutage > 0 {
+				if outage >= e.maxOutage {
+					fmt.Printf("Runner host has been unreachable for %s, giving up\n", outage.Round(time.Second))
 					return
 				}
-				command := string(bodyBytes)
-				logs, err := executeCommand(command)
-				client.Post(fmt.Sprintf("http://%s:%s/logs", runnerHost, runnerPort), "text/html; charset=utf-8", bytes.NewBuffer(logs))
-				doneMessage := CommandResponse{
-					ReturnCode: err.(*exec.ExitError).ExitCode(),
-					ErrorLogs:  string(err.(*exec.ExitError).Stderr),
-				}
-				fmt.Printf("Execution of command %s ended. Sending response: %+v", command, doneMessage)
-				payload, _ := json.Marshal(doneMessage)
-				client.Post(fmt.Sprintf("http://%s:%s/done", runnerHost, runnerPort), "text/html; charset=utf-8", bytes.NewBuffer(payload))
+				// Last attempt is made when outage window ends
+				wait = min(wait, e.maxOutage-outage)
 			}
+			sleep(ctx, wait)
+			continue
+		}
+		e.connection.succeeded()
+		if len(body) == 0 {
+			<-slots
+			continue
+		}
+
+		spec, specErr := parseJobSpec(body)
+		if len(spec.Id) == 0 {
+			spec.Id = newJobId()
 		}
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			defer func() { <-slots }()
+			e.run(ctx, spec, specErr)
+		}()
+	}
+}
+
+// run executes job and reports its result
+func (e *executor) run(ctx context.Context, spec JobSpec, specErr error) {
+	var result CommandResult
+	if specErr != nil {
+		fmt.Printf("Received invalid job %s. Error: %s\n", spec.Id, specErr.Error())
+		result = invalidJobResult(specErr)
+	} else {
+		jobCtx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		e.mu.Lock()
+		e.running[spec.Id] = cancel
+		e.mu.Unlock()
+		defer func() {
+			e.mu.Lock()
+			delete(e.running, spec.Id)
+			e.mu.Unlock()
+		}()
+
+		fmt.Printf("Starting job %s: %s\n", spec.Id, spec)
+		logs := newLogStreamer(e.reportCtx, e.client, e.url("/logs", spec.Id))
+		result = executeJob(jobCtx, spec, e.commandTimeout, e.cancelGracePeriod, logs)
+		logs.Close()
+	}
+	result.JobId = spec.Id
+
+	fmt.Printf("Execution of job %s ended with status %s and exit code %d\n", spec.Id, result.Status, result.ExitCode)
+	if err := e.report(result); err != nil {
+		fmt.Printf("Sending result of job %s failed. Error: %s\n", spec.Id, err.Error())
+	}
+}
+
+// cancel stops running job. Job's process group gets SIGTERM, and SIGKILL if it's still running after grace period.
+func (e *executor) cancel(jobId string) {
+	e.mu.Lock()
+	cancel, ok := e.running[jobId]
+	e.mu.Unlock()
+	if !ok {
+		fmt.Printf("Job %s to cancel is not running\n", jobId)
+		return
+	}
+	fmt.Printf("Cancelling job %s\n", jobId)
+	cancel(errJobCancelled)
+}
+
+func (e *executor) runningCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.running)
+}
+
+// pollCancels waits for cancel requests from GET /cancel, which returns {"jobId": "<id>"}. Only /poll tells whether
+// runner host is reachable, so failures here have their own backoff and don't change connection state.
+func (e *executor) pollCancels(ctx context.Context) {
+	failures := 0
+	for ctx.Err() == nil {
+		started := time.Now()
+		body, err := e.get(ctx, "/cancel")
+		if err != nil && ctx.Err() == nil {
+			failures++
+			fmt.Printf("Polling cancellations failed. Error: %s\n", err.Error())
+			sleep(ctx, backoff(failures, e.connection.maxBackoff))
+			continue
+		}
+		failures = 0
+		if err == nil && len(body) > 0 {
+			var request struct {
+				JobId string `json:"jobId"`
+			}
+			if err := json.Unmarshal(body, &request); err != nil || len(request.JobId) == 0 {
+				fmt.Printf("Invalid cancel request %q\n", body)
+			} else {
+				e.cancel(request.JobId)
+			}
+		}
+		// Don't hammer host that doesn't long poll
+		sleep(ctx, time.Second-time.Since(started))
+	}
+}
+
+// get returns authenticated body of the response, or nil if there's nothing to process
+func (e *executor) get(ctx context.Context, path string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, e.baseUrl+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := e.pollClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNoContent {
+		return nil, nil
 	}
+	if response.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return nil, fmt.Errorf("runner host responded %s", response.Status)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Some proxies turn 204 into 200 without body
+	if len(body) == 0 {
+		return nil, nil
+	}
+	if err := e.auth.verify(response, body); err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnauthenticated, err)
+	}
+	return body, nil
+}
+
+// report sends result of the job to POST /done?job=<id>
+func (e *executor) report(result CommandResult) error {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(e.reportCtx, http.MethodPost, e.url("/done", result.JobId), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("runner host responded %s", response.Status)
+	}
+	return nil
+}
+
+// url returns address of job specific endpoint
+func (e *executor) url(path string, jobId string) string {
+	return fmt.Sprintf("%s%s?%s", e.baseUrl, path, url.Values{"job": {jobId}}.Encode())
+}
+
+// connection tracks whether runner host is reachable, and how long to back off when it isn't
+type connection struct {
+	maxBackoff time.Duration
+
+	mu        sync.Mutex
+	connected bool
+	changed   time.Time
+	failures  int
+}
+
+func (c *connection) succeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		fmt.Printf("Connected to runner host after %s\n", time.Since(c.changed).Round(time.Second))
+		c.connected = true
+		c.changed = time.Now()
+	}
+	c.failures = 0
+}
+
+// failed returns time to wait before next attempt, and how long runner host has been unreachable
+func (c *connection) failed() (time.Duration, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected {
+		fmt.Printf("Lost connection to runner host after %s, reconnecting\n", time.Since(c.changed).Round(time.Second))
+		c.connected = false
+		c.changed = time.Now()
+	}
+	c.failures++
+	return backoff(c.failures, c.maxBackoff), time.Since(c.changed)
+}
+
+func (c *connection) state() (bool, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected, c.changed
+}
+
+// backoff grows exponentially from a second up to max. Random half of it is dropped, so that executors don't retry in sync.
+func backoff(attempt int, max time.Duration) time.Duration {
+	wait := max
+	if attempt < 30 {
+		wait = min(time.Second<<(attempt-1), max)
+	}
+	return wait/2 + time.Duration(mathrand.Int63n(int64(wait/2)+1))
+}
+
+func sleep(ctx context.Context, duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+// startHealthCheck serves state of the executor at HEALTH_PORT. / responds always when executor is running, and /ready only when
+// runner host is reachable.
+func (e *executor) startHealthCheck() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		e.health(w, false)
+	})
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		e.health(w, true)
+	})
+
+	port, portSet := os.LookupEnv("HEALTH_PORT")
+	if !portSet {
+		port = "5000"
+	}
+	fmt.Printf("Healthcheck serving at port %s\n", port)
+	err := http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Printf("error starting health check server: %s\n", err)
+	}
+}
+
+func (e *executor) health(w http.ResponseWriter, requireConnection bool) {
+	connected, since := e.connection.state()
+	status := http.StatusOK
+	if requireConnection && !connected {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"connected":   connected,
+		"since":       since,
+		"runningJobs": e.runningCount(),
+	})
 }
 
-func executeCommand(command string) ([]byte, error) {
-	output, err := exec.Command(command).Output()
+func newJobId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// executeJob streams output of the job to logs while it runs. Job is stopped when context is cancelled, or when it doesn't
+// end in its timeout or in default timeout if set.
+func executeJob(ctx context.Context, spec JobSpec, timeout time.Duration, gracePeriod time.Duration, logs *logStreamer) CommandResult {
+	if spec.TimeoutSeconds > 0 {
+		timeout = time.Duration(spec.TimeoutSeconds) * time.Second
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stderr := &tailBuffer{max: maxResultStderr}
+	execution, stopKill := spec.command(ctx, gracePeriod)
+	execution.Stdout = logs.Writer("stdout")
+	execution.Stderr = io.MultiWriter(stderr, logs.Writer("stderr"))
+
+	startedAt := time.Now()
+	err := execution.Run()
+	stopKill()
+	finishedAt := time.Now()
 	if err != nil {
 		fmt.Printf("Some error happened. Error: %s\n", err.Error())
 	}
-	return output, err
+
+	var stopCause error
+	if ctx.Err() != nil {
+		stopCause = context.Cause(ctx)
+		if errors.Is(stopCause, context.Canceled) {
+			stopCause = errExecutorStopped
+		}
+	}
+
+	result := commandResult(err, execution.ProcessState, stopCause)
+	result.StartedAt = startedAt
+	result.FinishedAt = finishedAt
+	result.DurationMs = finishedAt.Sub(startedAt).Milliseconds()
+	result.Stderr = stderr.String()
+	result.StderrTruncated = stderr.truncated
+	result.ReturnCode = result.ExitCode
+	result.ErrorLogs = result.Stderr
+	return result
 }
 
 func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
-	client, _ := newClient()
-	waitForCommands(ctx, client)
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		fmt.Printf("Invalid TLS configuration. Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	auth, err := loadRunnerAuth()
+	if err != nil {
+		fmt.Printf("Invalid authentication configuration. Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if !auth.enabled() {
+		fmt.Printf("Running commands without authentication\n")
+	}
+	client, err := newClient(tlsConfig, auth, 4)
+	if err != nil {
+		fmt.Printf("Could not create HTTP client. Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	pollClient, err := newClient(tlsConfig, auth, 0)
+	if err != nil {
+		fmt.Printf("Could not create HTTP client. Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	waitForCommands(ctx, client, pollClient, auth, tlsConfig != nil)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Version of CommandResult schema. Version 1 had only returnCode and errorLogs, and version 2 didn't have jobId.
+const resultSchemaVersion = 3
+
+// Only end of stderr is sent with the result, as the whole output is already streamed to logs
+const maxResultStderr = 16 * 1024
+
+// Status of ended command
+const (
+	StatusSuccess  = "success"
+	StatusFailure  = "failure"
+	StatusSignaled = "signaled"
+	StatusNotFound = "notFound"
+	StatusTimeout  = "timeout"
+	// Stopped by cancel request or shutdown of the executor
+	StatusCancelled = "cancelled"
+	// Command couldn't be started for other reason than missing executable
+	StatusError = "error"
+)
+
+// CommandResult is sent to /done for every command, however it ended
+type CommandResult struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	JobId         string `json:"jobId"`
+	Status        string `json:"status"`
+	// Exit code of the command. Follows shell conventions when command didn't exit by itself:
+	// 128+n when killed by signal n, 124 on timeout, 127 when not found and 126 when it couldn't be started.
+	ExitCode   int       `json:"exitCode"`
+	Signal     string    `json:"signal,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	DurationMs int64     `json:"durationMs"`
+	// End of stderr
+	Stderr          string `json:"stderr"`
+	StderrTruncated bool   `json:"stderrTruncated"`
+	// Reason why command couldn't be run
+	Error string `json:"error,omitempty"`
+
+	// Same as ExitCode, kept for version 1 consumers
+	ReturnCode int `json:"returnCode"`
+	// Same as Stderr, kept for version 1 consumers
+	ErrorLogs string `json:"errorLogs"`
+}
+
+// invalidJobResult reports job that couldn't be run at all
+func invalidJobResult(err error) CommandResult {
+	now := time.Now()
+	return CommandResult{
+		SchemaVersion: resultSchemaVersion,
+		Status:        StatusError,
+		ExitCode:      126,
+		StartedAt:     now,
+		FinishedAt:    now,
+		Error:         err.Error(),
+		ReturnCode:    126,
+	}
+}
+
+// commandResult tells how command ended based on error of the run and state of the process, if it was started.
+// Stop cause tells why command was stopped, if it didn't end by itself.
+// setExit of utils/file-executor classifies scripts the same way, and has to be changed with this.
+func commandResult(err error, state *os.ProcessState, stopCause error) CommandResult {
+	result := CommandResult{SchemaVersion: resultSchemaVersion}
+	switch {
+	case state == nil && (errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist)):
+		result.Status = StatusNotFound
+		result.ExitCode = 127
+		result.Error = err.Error()
+	case state == nil:
+		result.Status = StatusError
+		result.ExitCode = 126
+		if err != nil {
+			result.Error = err.Error()
+		}
+	case errors.Is(stopCause, context.DeadlineExceeded):
+		result.Status = StatusTimeout
+		result.ExitCode = 124
+		result.Error = "command timed out"
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			result.Signal = status.Signal().String()
+		}
+	case stopCause != nil:
+		result.Status = StatusCancelled
+		result.ExitCode = state.ExitCode()
+		result.Error = stopCause.Error()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			result.Signal = status.Signal().String()
+			result.ExitCode = 128 + int(status.Signal())
+		}
+	default:
+		result.ExitCode = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			result.Status = StatusSignaled
+			result.Signal = status.Signal().String()
+			result.ExitCode = 128 + int(status.Signal())
+		} else if result.ExitCode == 0 {
+			result.Status = StatusSuccess
+		} else {
+			result.Status = StatusFailure
+		}
+	}
+	return result
+}
+
+// tailBuffer keeps last max bytes written to it
+type tailBuffer struct {
+	max       int
+	data      []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.max {
+		b.data = append(b.data[:0], b.data[len(b.data)-b.max:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data)
+}
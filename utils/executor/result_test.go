@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// processState runs shell command and returns how it ended
+func processState(t *testing.T, script string) *os.ProcessState {
+	t.Helper()
+	command := exec.Command("/bin/sh", "-c", script)
+	command.Run()
+	if command.ProcessState == nil {
+		t.Fatalf("command %q didn't run", script)
+	}
+	return command.ProcessState
+}
+
+func TestCommandResult(t *testing.T) {
+	_, notFound := exec.LookPath("command-that-does-not-exist")
+
+	tests := []struct {
+		name       string
+		err        error
+		state      *os.ProcessState
+		stopCause  error
+		wantStatus string
+		wantCode   int
+		wantSignal string
+	}{
+		{name: "success", state: processState(t, "exit 0"), wantStatus: StatusSuccess, wantCode: 0},
+		{name: "failure", state: processState(t, "exit 3"), wantStatus: StatusFailure, wantCode: 3},
+		{name: "signaled", state: processState(t, "kill -TERM $$"), wantStatus: StatusSignaled, wantCode: 143, wantSignal: "terminated"},
+		{name: "not found", err: notFound, wantStatus: StatusNotFound, wantCode: 127},
+		{name: "not started", err: errors.New("permission denied"), wantStatus: StatusError, wantCode: 126},
+		{name: "timeout", state: processState(t, "kill -KILL $$"), stopCause: context.DeadlineExceeded, wantStatus: StatusTimeout, wantCode: 124, wantSignal: "killed"},
+		{name: "cancelled and killed", state: processState(t, "kill -TERM $$"), stopCause: errJobCancelled, wantStatus: StatusCancelled, wantCode: 143, wantSignal: "terminated"},
+		{name: "cancelled and exited", state: processState(t, "exit 2"), stopCause: errExecutorStopped, wantStatus: StatusCancelled, wantCode: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := commandResult(tt.err, tt.state, tt.stopCause)
+			if result.Status != tt.wantStatus || result.ExitCode != tt.wantCode || result.Signal != tt.wantSignal {
+				t.Errorf("got status %s, exit code %d and signal %q, want %s, %d and %q", result.Status, result.ExitCode, result.Signal, tt.wantStatus, tt.wantCode, tt.wantSignal)
+			}
+			if result.SchemaVersion != resultSchemaVersion {
+				t.Errorf("got schema version %d, want %d", result.SchemaVersion, resultSchemaVersion)
+			}
+			if tt.wantStatus != StatusSuccess && tt.wantStatus != StatusFailure && tt.wantStatus != StatusSignaled && len(result.Error) == 0 {
+				t.Error("error is not described")
+			}
+		})
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	buffer := &tailBuffer{max: 4}
+	buffer.Write([]byte("abc"))
+	if buffer.String() != "abc" || buffer.truncated {
+		t.Errorf("got %q, truncated %t", buffer.String(), buffer.truncated)
+	}
+	buffer.Write([]byte("def"))
+	if buffer.String() != "cdef" || !buffer.truncated {
+		t.Errorf("got %q, truncated %t", buffer.String(), buffer.truncated)
+	}
+}
@@ -2,7 +2,10 @@ module github.com/hi-fi/gha-runners-on-managed-env/utils/file-executor
 
 go 1.22.6
 
-require github.com/fsnotify/fsnotify v1.7.0
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gohugoio/hugo v0.133.1
+)
 
 require (
 	github.com/bep/godartsass v1.2.0 // indirect
@@ -10,7 +13,6 @@ require (
 	github.com/bep/golibsass v1.1.1 // indirect
 	github.com/cli/safeexec v1.0.1 // indirect
 	github.com/gobwas/glob v0.2.3 // indirect
-	github.com/gohugoio/hugo v0.133.1 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/pelletier/go-toml/v2 v2.2.2 // indirect
 	github.com/spf13/afero v1.11.0 // indirect
@@ -1,20 +1,320 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/gohugoio/hugo/watcher/filenotify"
 )
 
+const (
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+	// Killed by signal
+	StatusSignaled = "signaled"
+	// Shell or script was not found
+	StatusNotFound = "notFound"
+	// Killed as it ran longer than its timeout
+	StatusTimeout = "timeout"
+	// Stopped by <script>.cancel marker
+	StatusCancelled = "cancelled"
+	// Executor was restarted while script was running
+	StatusInterrupted = "interrupted"
+	// Script couldn't be run at all
+	StatusError = "error"
+)
+
+// CommandResponse is written to <script>.status.json when writeStatusFile is set. It's written before return code is
+// written to <script>.rc, so it's there when hook sees the return code.
 type CommandResponse struct {
-	ReturnCode int    `json:"returnCode"`
-	ErrorLogs  string `json:"errorLogs"`
+	Status string `json:"status"`
+	// Exit code of the script. 128+n when killed by signal n, 124 on timeout, 1 when cancelled before it was started or interrupted by restart, 127 when shell or script is not found and 126 when script couldn't be started.
+	ReturnCode int `json:"returnCode"`
+	// Reason why script couldn't be run
+	ErrorLogs  string    `json:"errorLogs,omitempty"`
+	Signal     string    `json:"signal,omitempty"`
+	Pid        int       `json:"pid,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	DurationMs int64     `json:"durationMs"`
+	// Bytes script wrote to the log file
+	StdoutBytes int64 `json:"stdoutBytes"`
+	StderrBytes int64 `json:"stderrBytes"`
+}
+
+// setExit classifies the run. State is nil when script never started, and stop cause is set when executor stopped it.
+// Statuses and exit codes are the same as in commandResult of utils/executor. This file is built alone, so the two are
+// kept in sync by hand.
+func (response *CommandResponse) setExit(err error, state *os.ProcessState, stopCause error) {
+	switch {
+	case state == nil && (errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist)):
+		response.Status = StatusNotFound
+		response.ReturnCode = 127
+		response.ErrorLogs = err.Error()
+	case state == nil:
+		response.Status = StatusError
+		response.ReturnCode = 126
+		if err != nil {
+			response.ErrorLogs = err.Error()
+		}
+	case errors.Is(stopCause, context.DeadlineExceeded):
+		response.Status = StatusTimeout
+		response.ReturnCode = 124
+		response.ErrorLogs = "script timed out"
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			response.Signal = status.Signal().String()
+		}
+	case stopCause != nil:
+		response.Status = StatusCancelled
+		response.ReturnCode = state.ExitCode()
+		response.ErrorLogs = stopCause.Error()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			response.Signal = status.Signal().String()
+			response.ReturnCode = 128 + int(status.Signal())
+		}
+	default:
+		response.ReturnCode = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			response.Status = StatusSignaled
+			response.Signal = status.Signal().String()
+			response.ReturnCode = 128 + int(status.Signal())
+		} else if response.ReturnCode == 0 {
+			response.Status = StatusSuccess
+		} else {
+			response.Status = StatusFailure
+		}
+	}
+}
+
+var errScriptCancelled = errors.New("script was cancelled")
+
+// Time script gets to stop after SIGTERM before it's killed
+var cancelGracePeriod = 10 * time.Second
+
+// Cancel functions of running scripts by script path
+var running = struct {
+	sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}{cancels: map[string]context.CancelCauseFunc{}}
+
+// cancelScript stops the script, if it's running
+func cancelScript(command string) {
+	running.Lock()
+	defer running.Unlock()
+	if cancel, ok := running.cancels[command]; ok {
+		log.Printf("Cancelling %s", command)
+		cancel(errScriptCancelled)
+	}
+}
+
+// Extra wait for the log file copy, e.g. when script left a daemon behind that inherited stdout
+const outputWaitDelay = 5 * time.Second
+
+// ScriptConfig is read from <script>.json manifest, or when it's missing, from <script>.env, <script>.cwd and
+// <script>.timeout files. Those have to be written before the script itself.
+type ScriptConfig struct {
+	// Added to environment of the executor
+	Env map[string]string `json:"env,omitempty"`
+	// Working directory of the script, working directory of the executor is used when empty
+	WorkingDirectory string `json:"workingDirectory,omitempty"`
+	// Script is killed after this many seconds, no timeout when 0
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+}
+
+// loadScriptConfig reads configuration of the script from the files next to it
+func loadScriptConfig(command string) (ScriptConfig, error) {
+	var config ScriptConfig
+	manifest, err := os.ReadFile(command + ".json")
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(manifest, &config); err != nil {
+			return config, fmt.Errorf("invalid manifest %s.json: %w", command, err)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		if config.Env, err = readEnvFile(command + ".env"); err != nil {
+			return config, err
+		}
+		if config.WorkingDirectory, err = readSidecarFile(command + ".cwd"); err != nil {
+			return config, err
+		}
+		timeout, err := readSidecarFile(command + ".timeout")
+		if err != nil {
+			return config, err
+		}
+		if timeout != "" {
+			if config.TimeoutSeconds, err = strconv.ParseFloat(timeout, 64); err != nil {
+				return config, fmt.Errorf("invalid timeout in %s.timeout: %w", command, err)
+			}
+		}
+	default:
+		return config, err
+	}
+
+	if config.TimeoutSeconds < 0 {
+		return config, fmt.Errorf("timeout of %s can't be negative", command)
+	}
+	if config.WorkingDirectory != "" {
+		if info, err := os.Stat(config.WorkingDirectory); err != nil {
+			return config, fmt.Errorf("invalid working directory: %w", err)
+		} else if !info.IsDir() {
+			return config, fmt.Errorf("working directory %s is not a directory", config.WorkingDirectory)
+		}
+	}
+	return config, nil
+}
+
+// readSidecarFile returns trimmed content of the file, or empty string if it doesn't exist
+func readSidecarFile(name string) (string, error) {
+	content, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(content)), err
+}
+
+// readEnvFile reads KEY=VALUE lines. Empty lines and lines starting with # are skipped.
+func readEnvFile(name string) (map[string]string, error) {
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	env := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid line %d in %s, expected KEY=VALUE", line, name)
+		}
+		env[key] = value
+	}
+	return env, scanner.Err()
+}
+
+// setError marks the script as one that couldn't be run
+func (response *CommandResponse) setError(err error) {
+	response.Status = StatusError
+	response.ReturnCode = 126
+	response.ErrorLogs = err.Error()
+}
+
+// countingWriter counts bytes written through it
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// Script is considered fully written when its size and modification time stay same this long, unless <script>.ready marker exists
+var settleTime = 500 * time.Millisecond
+
+// Scripts are run only after <script>.ready marker is written
+var requireReadyMarker = false
+
+// handleScript runs the script once it's fully written, unless it's already run or being run
+func handleScript(command string) {
+	if !waitUntilWritten(command) {
+		log.Printf("Script %s was removed before it was run", command)
+		return
+	}
+	if !claimScript(command) {
+		return
+	}
+	executeCommand(command)
+}
+
+// waitUntilWritten waits for ready marker or the script to stop changing. Returns false if script disappears meanwhile.
+func waitUntilWritten(command string) bool {
+	var previous os.FileInfo
+	for {
+		if _, err := os.Stat(command + ".ready"); err == nil {
+			return true
+		}
+		info, err := os.Stat(command)
+		if err != nil {
+			return false
+		}
+		if !requireReadyMarker && previous != nil && info.Size() == previous.Size() && info.ModTime().Equal(previous.ModTime()) {
+			return true
+		}
+		previous = info
+		time.Sleep(settleTime)
+	}
+}
+
+// Identifies this run of the executor in lock files. PID alone isn't enough, as restarted container gets the same PID again.
+var instanceId = fmt.Sprintf("%d-%d", time.Now().UnixNano(), os.Getpid())
+
+// claimScript creates <script>.lock exclusively, so that script is run only once even when it's seen multiple times.
+// Lock file is used instead of renaming the script, as hooks expect the script and its output files in the original path.
+func claimScript(command string) bool {
+	if _, err := os.Stat(command + ".rc"); err == nil {
+		log.Printf("Script %s is already completed, skipping", command)
+		return false
+	}
+	lock, err := os.OpenFile(command+".lock", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if errors.Is(err, fs.ErrExist) {
+		log.Printf("Script %s is already claimed, skipping", command)
+		return false
+	}
+	if err != nil {
+		log.Printf("Could not claim script %s: %s", command, err)
+		return false
+	}
+	defer lock.Close()
+	// Instance ID tells after restart whether the claim is stale
+	fmt.Fprint(lock, instanceId)
+	return true
+}
+
+// completeInterrupted writes completion files for script that was claimed by earlier run of the executor.
+// Script isn't run again, as it may have done part of its work already.
+func completeInterrupted(command string) {
+	if _, err := os.Stat(command + ".rc"); err == nil {
+		return
+	}
+	content, err := os.ReadFile(command + ".lock")
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(content)) == instanceId {
+		return
+	}
+	log.Printf("Script %s was interrupted by restart of the executor", command)
+	writeCompletionFile(command, &CommandResponse{
+		Status:     StatusInterrupted,
+		ReturnCode: 1,
+		ErrorLogs:  "executor was restarted while script was running",
+		StartedAt:  time.Now(),
+	})
 }
 
 func waitForCommands(watcher filenotify.FileWatcher) {
@@ -29,7 +329,10 @@ func waitForCommands(watcher filenotify.FileWatcher) {
 					log.Printf("File %s written\n", event.Name)
 					if strings.HasSuffix(event.Name, ".sh") {
 						os.Chmod(event.Name, 0777)
-						executeCommand(event.Name)
+						// Run in background, so that cancel markers are noticed while script is running
+						go handleScript(event.Name)
+					} else if strings.HasSuffix(event.Name, ".sh.cancel") {
+						cancelScript(strings.TrimSuffix(event.Name, ".cancel"))
 					} else {
 						log.Printf("File %s was either handled or with invalid extension", event.Name)
 					}
@@ -45,39 +348,156 @@ func waitForCommands(watcher filenotify.FileWatcher) {
 }
 
 func executeCommand(command string) {
-	// Expect that command will succeed
-	rc := 0
+	response := &CommandResponse{StartedAt: time.Now()}
 
-	defer writeCompletionFile(command, &rc)
+	defer writeCompletionFile(command, response)
 	log.Printf("Executing command %s", command)
 	commandContent, _ := os.ReadFile(command)
 	log.Println(string(commandContent))
 	outfile, err := os.Create(fmt.Sprintf("%s.log", command))
 	if err != nil {
 		fmt.Printf("Could not create output file. Error: %s\n", err.Error())
-		rc = 1
+		response.setError(err)
 		return
 	}
 	defer outfile.Close()
-	execution := exec.Command("/bin/sh", command)
-	execution.Stderr = outfile
-	execution.Stdout = outfile
 
-	err = execution.Run()
+	config, err := loadScriptConfig(command)
+	if err != nil {
+		fmt.Printf("Could not read configuration of the script. Error: %s\n", err.Error())
+		// Shown in step log, as that's where user looks for the reason
+		fmt.Fprintf(outfile, "Could not read configuration of the script: %s\n", err.Error())
+		response.setError(err)
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	running.Lock()
+	running.cancels[command] = cancel
+	running.Unlock()
+	defer func() {
+		running.Lock()
+		delete(running.cancels, command)
+		running.Unlock()
+	}()
+	// Marker may have been written before script was picked up
+	if _, err := os.Stat(command + ".cancel"); err == nil {
+		cancel(errScriptCancelled)
+	}
+
+	if config.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.TimeoutSeconds*float64(time.Second)))
+		defer cancel()
+	}
+
+	stdout := &countingWriter{writer: outfile}
+	stderr := &countingWriter{writer: outfile}
+	execution := exec.CommandContext(ctx, "/bin/sh", command)
+	execution.Stderr = stderr
+	execution.Stdout = stdout
+	execution.Dir = config.WorkingDirectory
+	execution.Env = os.Environ()
+	for key, value := range config.Env {
+		execution.Env = append(execution.Env, key+"="+value)
+	}
+	// Own process group, so that timeout and cancellation stop also processes started by the script. Same as command of
+	// utils/executor, except that timeout is hard and kills the group right away.
+	execution.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var killMu sync.Mutex
+	var kill *time.Timer
+	execution.Cancel = func() error {
+		processGroup := -execution.Process.Pid
+		if errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			return syscall.Kill(processGroup, syscall.SIGKILL)
+		}
+		killMu.Lock()
+		kill = time.AfterFunc(cancelGracePeriod, func() {
+			syscall.Kill(processGroup, syscall.SIGKILL)
+		})
+		killMu.Unlock()
+		return syscall.Kill(processGroup, syscall.SIGTERM)
+	}
+	execution.WaitDelay = cancelGracePeriod + outputWaitDelay
+
+	if ctx.Err() != nil {
+		fmt.Printf("Script %s was cancelled before it was started\n", command)
+		response.Status = StatusCancelled
+		response.ReturnCode = 1
+		response.ErrorLogs = errScriptCancelled.Error()
+		return
+	}
+	err = execution.Start()
+	if err == nil {
+		response.Pid = execution.Process.Pid
+		err = execution.Wait()
+		// Process group ID can be reused once the script has been waited for
+		killMu.Lock()
+		if kill != nil {
+			kill.Stop()
+		}
+		killMu.Unlock()
+	}
 	if err != nil {
 		fmt.Printf("Some error happened. Error: %s\n", err.Error())
-		rc = 1
 	}
+	response.setExit(err, execution.ProcessState, context.Cause(ctx))
+	response.StdoutBytes = stdout.count
+	response.StderrBytes = stderr.count
 }
 
-func writeCompletionFile(command string, rc *int) {
-	log.Println("Execution completed")
-	log.Printf("Writing return code %d to %s.rc", *rc, command)
-	os.WriteFile(fmt.Sprintf("%s.rc", command), []byte(fmt.Sprintf("%d ", *rc)), 0777)
+// Status of the script is written to <script>.status.json next to the return code
+var writeStatusFile = false
+
+func writeCompletionFile(command string, response *CommandResponse) {
+	response.FinishedAt = time.Now()
+	response.DurationMs = response.FinishedAt.Sub(response.StartedAt).Milliseconds()
+	log.Printf("Execution completed with status %s", response.Status)
+
+	if writeStatusFile {
+		status, err := json.Marshal(response)
+		if err == nil {
+			err = writeFileAtomic(fmt.Sprintf("%s.status.json", command), status)
+		}
+		if err != nil {
+			log.Printf("Could not write status of %s: %s", command, err)
+		}
+	}
+
+	log.Printf("Writing return code %d to %s.rc", response.ReturnCode, command)
+	if err := writeFileAtomic(fmt.Sprintf("%s.rc", command), []byte(fmt.Sprintf("%d ", response.ReturnCode))); err != nil {
+		log.Printf("Could not write return code of %s: %s", command, err)
+	}
+}
+
+// writeFileAtomic writes content to temporary file first and renames it then, so that reader never sees partial file
+func writeFileAtomic(name string, content []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, content, 0777); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
 }
 
 func main() {
 	watchDir := "/__w/_temp/"
+	if value, isSet := os.LookupEnv("CANCEL_GRACE_PERIOD"); isSet {
+		gracePeriod, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("CANCEL_GRACE_PERIOD %s is not valid duration", value)
+		}
+		cancelGracePeriod = gracePeriod
+	}
+	if value, isSet := os.LookupEnv("SCRIPT_SETTLE_TIME"); isSet {
+		settle, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("SCRIPT_SETTLE_TIME %s is not valid duration", value)
+		}
+		settleTime = settle
+	}
+	requireReadyMarker = os.Getenv("REQUIRE_READY_MARKER") == "true"
+	writeStatusFile = os.Getenv("WRITE_STATUS_FILE") == "true"
 	// Create new watcher.
 	watcher := filenotify.NewPollingWatcher(5)
 
@@ -89,7 +509,9 @@ func main() {
 	for _, file := range files {
 		if strings.HasSuffix(file.Name(), ".sh") {
 			log.Printf("Handling existing file %s", file.Name())
-			executeCommand(filepath.Join(watchDir, file.Name()))
+			command := filepath.Join(watchDir, file.Name())
+			completeInterrupted(command)
+			go handleScript(command)
 		}
 	}
 	watcher.Add(watchDir)
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processState runs shell command and returns how it ended
+func processState(t *testing.T, script string) *os.ProcessState {
+	t.Helper()
+	command := exec.Command("/bin/sh", "-c", script)
+	command.Run()
+	if command.ProcessState == nil {
+		t.Fatalf("command %q didn't run", script)
+	}
+	return command.ProcessState
+}
+
+// writeScript writes the script to a temporary directory and returns its path
+func writeScript(t *testing.T, content string) string {
+	t.Helper()
+	command := filepath.Join(t.TempDir(), "job.sh")
+	if err := os.WriteFile(command, []byte(content), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+// readStatus returns return code written by the executor and status, if it was written
+func readStatus(t *testing.T, command string) (string, *CommandResponse) {
+	t.Helper()
+	rc, err := os.ReadFile(command + ".rc")
+	if err != nil {
+		t.Fatalf("return code was not written: %v", err)
+	}
+	content, err := os.ReadFile(command + ".status.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return string(rc), nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response CommandResponse
+	if err := json.Unmarshal(content, &response); err != nil {
+		t.Fatalf("invalid status file: %v", err)
+	}
+	return string(rc), &response
+}
+
+func TestSetExit(t *testing.T) {
+	_, notFound := exec.LookPath("command-that-does-not-exist")
+
+	tests := []struct {
+		name       string
+		err        error
+		state      *os.ProcessState
+		stopCause  error
+		wantStatus string
+		wantCode   int
+		wantSignal string
+	}{
+		{name: "success", state: processState(t, "exit 0"), wantStatus: StatusSuccess, wantCode: 0},
+		{name: "failure", state: processState(t, "exit 3"), wantStatus: StatusFailure, wantCode: 3},
+		{name: "signaled", state: processState(t, "kill -TERM $$"), wantStatus: StatusSignaled, wantCode: 143, wantSignal: "terminated"},
+		{name: "not found", err: notFound, wantStatus: StatusNotFound, wantCode: 127},
+		{name: "script missing", err: &os.PathError{Op: "open", Path: "job.sh", Err: os.ErrNotExist}, wantStatus: StatusNotFound, wantCode: 127},
+		{name: "not started", err: errors.New("permission denied"), wantStatus: StatusError, wantCode: 126},
+		{name: "timeout", state: processState(t, "kill -KILL $$"), stopCause: context.DeadlineExceeded, wantStatus: StatusTimeout, wantCode: 124, wantSignal: "killed"},
+		{name: "cancelled and killed", state: processState(t, "kill -TERM $$"), stopCause: errScriptCancelled, wantStatus: StatusCancelled, wantCode: 143, wantSignal: "terminated"},
+		{name: "cancelled and exited", state: processState(t, "exit 2"), stopCause: errScriptCancelled, wantStatus: StatusCancelled, wantCode: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &CommandResponse{}
+			response.setExit(tt.err, tt.state, tt.stopCause)
+			if response.Status != tt.wantStatus || response.ReturnCode != tt.wantCode || response.Signal != tt.wantSignal {
+				t.Errorf("got status %s, return code %d and signal %q, want %s, %d and %q", response.Status, response.ReturnCode, response.Signal, tt.wantStatus, tt.wantCode, tt.wantSignal)
+			}
+			if tt.wantStatus != StatusSuccess && tt.wantStatus != StatusFailure && tt.wantStatus != StatusSignaled && len(response.ErrorLogs) == 0 {
+				t.Error("error is not described")
+			}
+		})
+	}
+}
+
+func TestExecuteCommandWritesReturnCode(t *testing.T) {
+	writeStatusFile = false
+	command := writeScript(t, "echo out; echo err >&2; exit 3")
+
+	executeCommand(command)
+
+	rc, status := readStatus(t, command)
+	if rc != "3 " {
+		t.Errorf("got return code %q, want 3", rc)
+	}
+	if status != nil {
+		t.Errorf("status file was written when it was not asked for: %+v", status)
+	}
+	if output, _ := os.ReadFile(command + ".log"); string(output) != "out\nerr\n" {
+		t.Errorf("got output %q", output)
+	}
+}
+
+func TestExecuteCommandWritesStatusFile(t *testing.T) {
+	writeStatusFile = true
+	defer func() { writeStatusFile = false }()
+	command := writeScript(t, "echo out; echo error >&2; exit 3")
+
+	executeCommand(command)
+
+	rc, status := readStatus(t, command)
+	if status == nil {
+		t.Fatal("status file was not written")
+	}
+	if rc != "3 " || status.Status != StatusFailure || status.ReturnCode != 3 {
+		t.Errorf("got return code %q and status %+v, want failure with 3", rc, status)
+	}
+	if status.Pid == 0 || status.StartedAt.IsZero() || status.FinishedAt.Before(status.StartedAt) || status.DurationMs < 0 {
+		t.Errorf("process or timing missing from status %+v", status)
+	}
+	if status.StdoutBytes != 4 || status.StderrBytes != 6 {
+		t.Errorf("got %d bytes of stdout and %d of stderr, want 4 and 6", status.StdoutBytes, status.StderrBytes)
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "variables", content: "A=1\n\n# comment\n  B=two words  \nC=\nD=x=y\n", want: map[string]string{"A": "1", "B": "two words", "C": "", "D": "x=y"}},
+		{name: "line without value", content: "A=1\nB\n", wantErr: "invalid line 2"},
+		{name: "line without key", content: "=1\n", wantErr: "invalid line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "job.sh.env")
+			os.WriteFile(name, []byte(tt.content), 0o600)
+			env, err := readEnvFile(name)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(env, tt.want) {
+				t.Errorf("got %v and error %v, want %v", env, err, tt.want)
+			}
+		})
+	}
+
+	if env, err := readEnvFile(filepath.Join(t.TempDir(), "missing.env")); env != nil || err != nil {
+		t.Errorf("missing file got %v and error %v, want neither", env, err)
+	}
+}
+
+func TestLoadScriptConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0o600)
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    ScriptConfig
+		wantErr string
+	}{
+		{name: "no configuration", want: ScriptConfig{}},
+		{
+			name:  "sidecar files",
+			files: map[string]string{".env": "A=1\n", ".cwd": dir + "\n", ".timeout": " 1.5\n"},
+			want:  ScriptConfig{Env: map[string]string{"A": "1"}, WorkingDirectory: dir, TimeoutSeconds: 1.5},
+		},
+		{
+			name:  "manifest wins over sidecar files",
+			files: map[string]string{".json": `{"env": {"B": "2"}, "workingDirectory": "` + dir + `", "timeoutSeconds": 10}`, ".env": "A=1\n", ".timeout": "5"},
+			want:  ScriptConfig{Env: map[string]string{"B": "2"}, WorkingDirectory: dir, TimeoutSeconds: 10},
+		},
+		{name: "invalid manifest", files: map[string]string{".json": `{"env": `}, wantErr: "invalid manifest"},
+		{name: "invalid timeout", files: map[string]string{".timeout": "1m"}, wantErr: "invalid timeout"},
+		{name: "negative timeout", files: map[string]string{".json": `{"timeoutSeconds": -1}`}, wantErr: "can't be negative"},
+		{name: "invalid env file", files: map[string]string{".env": "A\n"}, wantErr: "invalid line 1"},
+		{name: "missing working directory", files: map[string]string{".cwd": "/does/not/exist"}, wantErr: "invalid working directory"},
+		{name: "working directory is a file", files: map[string]string{".cwd": file}, wantErr: "is not a directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := filepath.Join(t.TempDir(), "job.sh")
+			for suffix, content := range tt.files {
+				os.WriteFile(command+suffix, []byte(content), 0o600)
+			}
+			config, err := loadScriptConfig(command)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("got %+v and error %v, want %+v", config, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteCommandAppliesConfig(t *testing.T) {
+	dir := t.TempDir()
+	command := writeScript(t, `echo "$A $(pwd)"`)
+	os.WriteFile(command+".env", []byte("A=from-env-file\n"), 0o600)
+	os.WriteFile(command+".cwd", []byte(dir), 0o600)
+
+	executeCommand(command)
+
+	if rc, _ := readStatus(t, command); rc != "0 " {
+		t.Errorf("got return code %q, want 0", rc)
+	}
+	if output, _ := os.ReadFile(command + ".log"); string(output) != "from-env-file "+dir+"\n" {
+		t.Errorf("got output %q", output)
+	}
+}
+
+func TestExecuteCommandTimesOut(t *testing.T) {
+	writeStatusFile = true
+	defer func() { writeStatusFile = false }()
+	command := writeScript(t, "sleep 10")
+	os.WriteFile(command+".timeout", []byte("0.1"), 0o600)
+
+	started := time.Now()
+	executeCommand(command)
+
+	rc, status := readStatus(t, command)
+	if rc != "124 " || status.Status != StatusTimeout {
+		t.Errorf("got return code %q and status %+v, want timeout", rc, status)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("timed out script ran %s", time.Since(started))
+	}
+}
+
+func TestExecuteCommandReportsInvalidConfig(t *testing.T) {
+	command := writeScript(t, "echo should not run")
+	os.WriteFile(command+".timeout", []byte("soon"), 0o600)
+
+	executeCommand(command)
+
+	if rc, _ := readStatus(t, command); rc != "126 " {
+		t.Errorf("got return code %q, want 126", rc)
+	}
+	if output, _ := os.ReadFile(command + ".log"); !strings.Contains(string(output), "invalid timeout") {
+		t.Errorf("reason is missing from step log %q", output)
+	}
+}
+
+// executeInBackground runs the script and returns channel that is closed when it has completed
+func executeInBackground(t *testing.T, command string) chan struct{} {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		executeCommand(command)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		running.Lock()
+		_, ok := running.cancels[command]
+		running.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("script was not started")
+		}
+	}
+	// Give shell time to set its traps
+	time.Sleep(100 * time.Millisecond)
+	return done
+}
+
+func TestCancelStopsProcessGroup(t *testing.T) {
+	writeStatusFile = true
+	defer func() { writeStatusFile = false }()
+	cancelGracePeriod = time.Minute
+	defer func() { cancelGracePeriod = 10 * time.Second }()
+	// Child of the shell would keep output open if only the shell got the signal
+	command := writeScript(t, "trap 'exit 3' TERM; sleep 30 & wait")
+
+	done := executeInBackground(t, command)
+	started := time.Now()
+	cancelScript(command)
+	<-done
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("script was stopped after %s, want it to stop on SIGTERM", elapsed)
+	}
+	rc, status := readStatus(t, command)
+	if rc != "3 " || status.Status != StatusCancelled || status.ErrorLogs != errScriptCancelled.Error() {
+		t.Errorf("got return code %q and status %+v, want cancelled with 3 from TERM trap", rc, status)
+	}
+}
+
+func TestCancelKillsScriptIgnoringTerm(t *testing.T) {
+	writeStatusFile = true
+	defer func() { writeStatusFile = false }()
+	cancelGracePeriod = 100 * time.Millisecond
+	defer func() { cancelGracePeriod = 10 * time.Second }()
+	command := writeScript(t, "trap '' TERM; sleep 30")
+
+	done := executeInBackground(t, command)
+	cancelScript(command)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("script ignoring SIGTERM was not killed")
+	}
+
+	rc, status := readStatus(t, command)
+	if rc != "137 " || status.Status != StatusCancelled || status.Signal != "killed" {
+		t.Errorf("got return code %q and status %+v, want cancelled and killed", rc, status)
+	}
+}
+
+func TestCancelMarkerWrittenBeforeStart(t *testing.T) {
+	command := writeScript(t, "touch \"$0.ran\"")
+	os.WriteFile(command+".cancel", nil, 0o600)
+
+	executeCommand(command)
+
+	if rc, _ := readStatus(t, command); rc != "1 " {
+		t.Errorf("got return code %q, want 1", rc)
+	}
+	if _, err := os.Stat(command + ".ran"); err == nil {
+		t.Error("cancelled script was run")
+	}
+}
+
+func TestClaimScript(t *testing.T) {
+	command := writeScript(t, "true")
+
+	if !claimScript(command) {
+		t.Fatal("new script was not claimed")
+	}
+	if lock, _ := os.ReadFile(command + ".lock"); string(lock) != instanceId {
+		t.Errorf("got lock %q, want instance ID %q", lock, instanceId)
+	}
+	if claimScript(command) {
+		t.Error("claimed script was claimed again")
+	}
+
+	completed := writeScript(t, "true")
+	os.WriteFile(completed+".rc", []byte("0 "), 0o600)
+	if claimScript(completed) {
+		t.Error("completed script was claimed")
+	}
+}
+
+func TestCompleteInterrupted(t *testing.T) {
+	tests := []struct {
+		name       string
+		lock       string
+		rc         string
+		wantRc     string
+		wantStatus string
+	}{
+		{name: "claimed by earlier executor", lock: "1-1", wantRc: "1 ", wantStatus: StatusInterrupted},
+		{name: "claimed by this executor", lock: instanceId},
+		{name: "not claimed"},
+		{name: "already completed", lock: "1-1", rc: "0 ", wantRc: "0 "},
+	}
+	writeStatusFile = true
+	defer func() { writeStatusFile = false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := writeScript(t, "true")
+			if len(tt.lock) > 0 {
+				os.WriteFile(command+".lock", []byte(tt.lock), 0o600)
+			}
+			if len(tt.rc) > 0 {
+				os.WriteFile(command+".rc", []byte(tt.rc), 0o600)
+			}
+
+			completeInterrupted(command)
+
+			rc, err := os.ReadFile(command + ".rc")
+			if len(tt.wantRc) == 0 {
+				if err == nil {
+					t.Errorf("got return code %q for script that may still run", rc)
+				}
+				return
+			}
+			if string(rc) != tt.wantRc {
+				t.Errorf("got return code %q, want %q", rc, tt.wantRc)
+			}
+			_, status := readStatus(t, command)
+			if len(tt.wantStatus) > 0 && (status == nil || status.Status != tt.wantStatus) {
+				t.Errorf("got status %+v, want %s", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWaitUntilWritten(t *testing.T) {
+	settleTime = 50 * time.Millisecond
+	defer func() { settleTime = 500 * time.Millisecond }()
+
+	t.Run("script stops changing", func(t *testing.T) {
+		command := writeScript(t, "echo start\n")
+		go func() {
+			// Appended while executor waits for the script to settle
+			time.Sleep(settleTime / 2)
+			file, _ := os.OpenFile(command, os.O_APPEND|os.O_WRONLY, 0)
+			file.WriteString("echo end\n")
+			file.Close()
+		}()
+		if !waitUntilWritten(command) {
+			t.Fatal("written script was not accepted")
+		}
+		if content, _ := os.ReadFile(command); string(content) != "echo start\necho end\n" {
+			t.Errorf("script was accepted before it was fully written, got %q", content)
+		}
+	})
+
+	t.Run("ready marker", func(t *testing.T) {
+		requireReadyMarker = true
+		defer func() { requireReadyMarker = false }()
+		command := writeScript(t, "true")
+		accepted := make(chan bool)
+		go func() { accepted <- waitUntilWritten(command) }()
+
+		select {
+		case <-accepted:
+			t.Fatal("script was accepted without ready marker")
+		case <-time.After(5 * settleTime):
+		}
+		os.WriteFile(command+".ready", nil, 0o600)
+		if !<-accepted {
+			t.Error("script with ready marker was not accepted")
+		}
+	})
+
+	t.Run("script removed", func(t *testing.T) {
+		command := writeScript(t, "true")
+		os.Remove(command)
+		if waitUntilWritten(command) {
+			t.Error("removed script was accepted")
+		}
+	})
+}
+
+func TestHandleScriptRunsOnce(t *testing.T) {
+	settleTime = 10 * time.Millisecond
+	defer func() { settleTime = 500 * time.Millisecond }()
+	command := writeScript(t, "echo run >> \"$0.runs\"")
+
+	// Polling watcher may report the same script more than once
+	done := make(chan struct{})
+	for range 3 {
+		go func() {
+			handleScript(command)
+			done <- struct{}{}
+		}()
+	}
+	for range 3 {
+		<-done
+	}
+	handleScript(command)
+
+	if runs, _ := os.ReadFile(command + ".runs"); string(runs) != "run\n" {
+		t.Errorf("got runs %q, want script run once", runs)
+	}
+}